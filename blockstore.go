@@ -0,0 +1,230 @@
+package edis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/ncw/directio"
+)
+
+// BlockStore holds the encrypted files of blocks. Keys are relative to the
+// store, use "/" as a separator, and are what Block.Location records.
+type BlockStore interface {
+	// Put stores p under key, replacing anything already there.
+	Put(key string, p []byte) error
+	// Get returns what is stored under key.
+	Get(key string) ([]byte, error)
+	// GetRange returns length bytes at offset of what is stored under key.
+	GetRange(key string, offset int64, length int) ([]byte, error)
+	// Delete removes key. Deleting a key that does not exist is not an error.
+	Delete(key string) error
+	Exists(key string) (bool, error)
+	// Size returns the size of what is stored under key.
+	Size(key string) (int64, error)
+	// ModTime returns when what is stored under key was last written.
+	ModTime(key string) (time.Time, error)
+	// List returns every key starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// localBlockStore keeps blocks as files under a local directory.
+type localBlockStore struct {
+	root              string
+	isDirectIOEnabled bool
+}
+
+// MakeLocalBlockStore returns a BlockStore that keeps blocks as files under
+// the directory root, written with directIO if isDirectIOEnabled is set.
+func MakeLocalBlockStore(root string, isDirectIOEnabled bool) BlockStore {
+	return &localBlockStore{root: root, isDirectIOEnabled: isDirectIOEnabled}
+}
+
+// path returns the file backing key. Blocks stored before locations were
+// relative may still have absolute ones.
+func (s *localBlockStore) path(key string) string {
+	if filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Put writes p to a temporary file, syncs it and renames it over the file
+// backing key, so that a crash leaves either the old file or the new one.
+func (s *localBlockStore) Put(key string, p []byte) error {
+	path := s.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath, err := makeTemporaryKey(path)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeFile(temporaryPath, p)
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	err = os.Rename(temporaryPath, path)
+	if err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return syncDirectory(filepath.Dir(path))
+}
+
+// writeFile creates the file at path, which must not exist, and syncs p to it.
+func (s *localBlockStore) writeFile(path string, p []byte) error {
+	var f *os.File
+	var err error
+	if s.isDirectIOEnabled {
+		if len(p)%directio.BlockSize != 0 {
+			return fmt.Errorf("Passed buffer was not a multilpe of the directio block size\n")
+		}
+
+		f, err = directio.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+
+		aligned := directio.AlignedBlock(len(p))
+		copy(aligned, p)
+		p = aligned
+	} else {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.Write(p)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *localBlockStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(key))
+}
+
+func (s *localBlockStore) GetRange(key string, offset int64, length int) ([]byte, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return []byte{}, err
+	}
+	defer f.Close()
+
+	p := make([]byte, length)
+	_, err = f.ReadAt(p, offset)
+	if err != nil {
+		return []byte{}, err
+	}
+	return p, nil
+}
+
+func (s *localBlockStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlockStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localBlockStore) Size(key string) (int64, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *localBlockStore) ModTime(key string) (time.Time, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (s *localBlockStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		key, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// migrateAbsoluteLocations makes the locations of blocks stored under root,
+// recorded when Location held absolute paths, relative to it.
+func migrateAbsoluteLocations(db *gorm.DB, root string) error {
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	return db.Exec("UPDATE blocks SET location = substr(location, ?) "+
+		"WHERE substr(location, 1, ?) = ?", len(prefix)+1, len(prefix), prefix).Error
+}
+
+// temporarySuffix ends the keys of files that are being written. Files left
+// with it by a crash are removed by CollectGarbage.
+const temporarySuffix = ".partial"
+
+// makeTemporaryKey returns a key next to key, unique to one write, for a file
+// that will be renamed to key once it is complete.
+func makeTemporaryKey(key string) (string, error) {
+	name := make([]byte, 8)
+	_, err := rand.Read(name)
+	if err != nil {
+		return "", err
+	}
+	return key + "." + hex.EncodeToString(name) + temporarySuffix, nil
+}
+
+// syncDirectory makes renames into the directory at path durable.
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	if err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,41 @@
+package edis
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLocalBlockStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "edis_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	store := MakeLocalBlockStore(root, false)
+	err = store.Put("a/b.edis", []byte("block"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := store.Get("a/b.edis")
+	if err != nil || string(p) != "block" {
+		t.Fatalf("Get returned %q and %v", p, err)
+	}
+
+	keys, err := store.List("a/")
+	if err != nil || len(keys) != 1 || keys[0] != "a/b.edis" {
+		t.Fatalf("List returned %v and %v", keys, err)
+	}
+
+	err = store.Delete("a/b.edis")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := store.Exists("a/b.edis")
+	if err != nil || exists {
+		t.Fatalf("Deleted key still exists")
+	}
+}
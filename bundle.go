@@ -0,0 +1,397 @@
+package edis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+var bundleMagic = []byte("EDISAR01")
+
+// A bundle holds a version of an object outside of any repository, encrypted
+// with a key of its own:
+//
+//	"EDISAR01"
+//	record: JSON of the MasterKeyInfo of the bundle key
+//	sealed record: JSON of the bundleManifest
+//	sealed record: ID, index (uint32) and content of each included block, in order
+//
+// A record is its length (uint32) followed by its bytes, and a sealed record
+// is three records holding the nonce, tag and ciphertext of its content.
+type bundleManifest struct {
+	ID      []byte // random, so that blocks of another bundle are not taken for its own
+	Version ObjectVersion
+
+	// BaseVersion is the version of the object whose blocks were left out
+	// of the bundle when they had the same content, or 0 if none were.
+	BaseVersion int
+	Blocks      []bundleBlock
+}
+
+type bundleBlock struct {
+	BlockIndex        int
+	ByteOffset        int64
+	ByteLength        int
+	IsHole            bool
+	Checksum          string // as recorded in the exporting repository
+	ChecksumAlgorithm string
+	ContentHash       string // SHA-256 of the content, if it is left out
+	BaseIndex         int    // index of the base block with the same content, or -1 if it is included
+}
+
+func writeBundleRecord(w io.Writer, p []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(p)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(p)
+	return err
+}
+
+func writeSealedBundleRecord(w io.Writer, key, p []byte) error {
+	ciphertext, nonce, tag, err := encryptBlock(key, p)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range [][]byte{nonce, tag, ciphertext} {
+		err = writeBundleRecord(w, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records are read before they can be authenticated, so their lengths are
+// checked against these bounds before anything is allocated for them.
+const (
+	maxBundleInfoSize     = 64 * 1024
+	maxBundleManifestSize = 256 * 1024 * 1024
+)
+
+// readBundleRecord reads a record, failing if it is longer than maxLength.
+func readBundleRecord(r io.Reader, maxLength int) ([]byte, error) {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return []byte{}, err
+	} else if int64(length) > int64(maxLength) {
+		return []byte{}, fmt.Errorf("Record of %d bytes is longer than the %d expected", length, maxLength)
+	}
+
+	p := make([]byte, length)
+	_, err = io.ReadFull(r, p)
+	return p, err
+}
+
+func readSealedBundleRecord(r io.Reader, key []byte, maxLength int) ([]byte, error) {
+	var records [3][]byte
+	for i := 0; i < len(records); i++ {
+		var err error
+		records[i], err = readBundleRecord(r, maxLength)
+		if err != nil {
+			return []byte{}, fmt.Errorf("Bundle is truncated: %v", err)
+		}
+	}
+	return decryptBlock(key, records[2], records[0], records[1])
+}
+
+func skipSealedBundleRecord(r io.Reader, maxLength int) error {
+	for i := 0; i < 3; i++ {
+		_, err := readBundleRecord(r, maxLength)
+		if err != nil {
+			return fmt.Errorf("Bundle is truncated: %v", err)
+		}
+	}
+	return nil
+}
+
+// bundleIDSize is the size of the random ID of a bundle.
+const bundleIDSize = 16
+
+// writeBundleBlock writes the content of an included block, preceded by what
+// identifies it, as a sealed record.
+func writeBundleBlock(w io.Writer, key, id []byte, blockIndex int, p []byte) error {
+	record := make([]byte, len(id)+4, len(id)+4+len(p))
+	copy(record, id)
+	binary.BigEndian.PutUint32(record[len(id):], uint32(blockIndex))
+	return writeSealedBundleRecord(w, key, append(record, p...))
+}
+
+// getBundleBlockRecordSize returns the longest a record holding a block of ov
+// can be.
+func getBundleBlockRecordSize(ov ObjectVersion) int {
+	return bundleIDSize + 4 + ov.BlockSize
+}
+
+// readBundleBlock reads the content of an included block of ov, checking that
+// it is the one expected.
+func readBundleBlock(r io.Reader, key, id []byte, ov ObjectVersion, blockIndex int) ([]byte, error) {
+	record, err := readSealedBundleRecord(r, key, getBundleBlockRecordSize(ov))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(record) < len(id)+4 || !bytes.Equal(record[:len(id)], id) ||
+		binary.BigEndian.Uint32(record[len(id):]) != uint32(blockIndex) {
+		return []byte{}, fmt.Errorf("Bundle does not have block %d where expected", blockIndex)
+	}
+	return record[len(id)+4:], nil
+}
+
+func computeContentHash(p []byte) string {
+	hash := sha256.Sum256(p)
+	return hex.EncodeToString(hash[:])
+}
+
+// ExportObjectVersion writes a version of an object to w as a bundle
+// encrypted with a key taken from either key or passphrase. If baseVersion
+// is not 0, blocks whose content that version of the object also has are
+// left out, and the bundle can only be imported where that content is.
+func (e *Engine) ExportObjectVersion(w io.Writer, name string, version, baseVersion int, key []byte, passphrase string) error {
+	err := validateKeySource(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	ov, err := e.getObjectVersion(name, version)
+	if err != nil {
+		return fmt.Errorf("Could not find version %d of object %s: %v", version, name, err)
+	}
+
+	blocks, err := e.loadBlockInfos(name, version)
+	if err != nil {
+		return err
+	}
+
+	inBase := make(map[string]int)
+	if baseVersion != 0 {
+		base, err := e.loadBlockInfos(name, baseVersion)
+		if err != nil {
+			return fmt.Errorf("Could not load base version %d of %s: %v", baseVersion, name, err)
+		}
+
+		for _, b := range base {
+			if !b.IsHole {
+				inBase[b.ChecksumAlgorithm+":"+b.Checksum] = b.BlockIndex
+			}
+		}
+	}
+
+	manifest := bundleManifest{ID: make([]byte, bundleIDSize), Version: ov, BaseVersion: baseVersion}
+	_, err = rand.Read(manifest.ID)
+	if err != nil {
+		return err
+	}
+
+	// Only the blocks that are left out are read here, for their hash, and
+	// included ones once as they are written.
+	for _, b := range blocks {
+		entry := bundleBlock{
+			BlockIndex:        b.BlockIndex,
+			ByteOffset:        getBlockOffset(b, ov.BlockSize),
+			ByteLength:        b.ByteLength,
+			IsHole:            b.IsHole,
+			Checksum:          b.Checksum,
+			ChecksumAlgorithm: b.ChecksumAlgorithm,
+			BaseIndex:         -1,
+		}
+
+		if index, found := inBase[b.ChecksumAlgorithm+":"+b.Checksum]; found && !b.IsHole {
+			p, err := e.readBlock(b)
+			if err != nil {
+				return err
+			}
+
+			entry.ContentHash = computeContentHash(p)
+			entry.BaseIndex = index
+		}
+		manifest.Blocks = append(manifest.Blocks, entry)
+	}
+
+	info, bundleKey, err := makeMasterKeyInfo(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	encodedInfo, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	encodedManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bundleMagic)
+	if err != nil {
+		return err
+	}
+
+	err = writeBundleRecord(w, encodedInfo)
+	if err != nil {
+		return err
+	}
+
+	err = writeSealedBundleRecord(w, bundleKey, encodedManifest)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range manifest.Blocks {
+		if entry.IsHole || entry.BaseIndex >= 0 {
+			continue
+		}
+
+		p, err := e.readBlock(blocks[i])
+		if err != nil {
+			return err
+		}
+
+		err = writeBundleBlock(w, bundleKey, manifest.ID, entry.BlockIndex, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportObjectVersion adds the version of an object in the bundle read from
+// r, encrypted with a key taken from either key or passphrase, as the next
+// version of the object with the given name, or with the name it was exported
+// with if name is empty. Blocks the bundle left out are taken from baseVersion
+// of the object, or from its latest version if baseVersion is 0. Blocks that
+// are already stored are not stored again.
+func (e *Engine) ImportObjectVersion(r io.Reader, name string, baseVersion int, key []byte, passphrase string) (ObjectVersion, SyncStats, error) {
+	stats := SyncStats{}
+	err := validateKeySource(key, passphrase)
+	if err != nil {
+		return ObjectVersion{}, stats, err
+	}
+
+	magic := make([]byte, len(bundleMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, bundleMagic) {
+		return ObjectVersion{}, stats, fmt.Errorf("Not an edis bundle")
+	}
+
+	encodedInfo, err := readBundleRecord(r, maxBundleInfoSize)
+	if err != nil {
+		return ObjectVersion{}, stats, fmt.Errorf("Bundle is truncated: %v", err)
+	}
+
+	var info MasterKeyInfo
+	err = json.Unmarshal(encodedInfo, &info)
+	if err != nil {
+		return ObjectVersion{}, stats, err
+	}
+
+	bundleKey, err := deriveMasterKey(info, key, passphrase)
+	if err != nil {
+		return ObjectVersion{}, stats, err
+	}
+
+	err = verifyMasterKey(info, bundleKey)
+	if err != nil {
+		return ObjectVersion{}, stats, fmt.Errorf("Key does not match the one the bundle was exported with")
+	}
+
+	encodedManifest, err := readSealedBundleRecord(r, bundleKey, maxBundleManifestSize)
+	if err != nil {
+		return ObjectVersion{}, stats, err
+	}
+
+	var manifest bundleManifest
+	err = json.Unmarshal(encodedManifest, &manifest)
+	if err != nil {
+		return ObjectVersion{}, stats, err
+	}
+
+	ov := manifest.Version
+	if name != "" {
+		ov.Name = name
+	}
+
+	var base []Block
+	if manifest.BaseVersion != 0 {
+		if baseVersion == 0 {
+			baseVersion, err = e.GetLatestVersionNumber(ov.Name)
+			if err != nil {
+				return ov, stats, fmt.Errorf("Bundle needs a base version of %s: %v", ov.Name, err)
+			}
+		}
+
+		base, err = e.loadBlockInfos(ov.Name, baseVersion)
+		if err != nil {
+			return ov, stats, err
+		}
+	}
+
+	ov.Version, err = e.getNextVersionNumber(ov.Name)
+	if err != nil {
+		return ov, stats, err
+	}
+
+	blocks := make([]Block, len(manifest.Blocks))
+	for i, entry := range manifest.Blocks {
+		blocks[i] = Block{
+			BlockIndex:        entry.BlockIndex,
+			ByteOffset:        entry.ByteOffset,
+			ByteLength:        entry.ByteLength,
+			IsHole:            entry.IsHole,
+			Checksum:          entry.Checksum,
+			ChecksumAlgorithm: entry.ChecksumAlgorithm,
+		}
+	}
+
+	// Included blocks are in r in order, and those that are not needed are
+	// skipped. Blocks taken from the base version are checked against their
+	// hash.
+	next := 0
+	read := func(b Block) ([]byte, error) {
+		entry := manifest.Blocks[b.BlockIndex]
+		if entry.BaseIndex >= 0 {
+			if entry.BaseIndex >= len(base) {
+				return []byte{}, fmt.Errorf("Base version %d of %s has no block %d", baseVersion, ov.Name, entry.BaseIndex)
+			}
+
+			p, err := e.readBlock(base[entry.BaseIndex])
+			if err != nil {
+				return []byte{}, err
+			} else if computeContentHash(p) != entry.ContentHash {
+				return []byte{}, fmt.Errorf("Block %d of the base version does not have the content block %d was exported with",
+					entry.BaseIndex, b.BlockIndex)
+			}
+			return p, nil
+		}
+
+		for ; next < b.BlockIndex; next++ {
+			isIncluded := !manifest.Blocks[next].IsHole && manifest.Blocks[next].BaseIndex < 0
+			if isIncluded {
+				err := skipSealedBundleRecord(r, getBundleBlockRecordSize(manifest.Version))
+				if err != nil {
+					return []byte{}, err
+				}
+			}
+		}
+
+		next++
+		return readBundleBlock(r, bundleKey, manifest.ID, manifest.Version, b.BlockIndex)
+	}
+
+	err = e.copyObjectVersion(ov, blocks, read, &stats)
+	if err != nil {
+		return ov, stats, err
+	}
+
+	stats.Versions++
+	return ov, stats, nil
+}
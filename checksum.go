@@ -0,0 +1,87 @@
+package edis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spacemonkeygo/openssl"
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Checksum algorithms that can be used to fingerprint blocks.
+const (
+	ChecksumSHA1    = "sha1" // only used by repositories created before SHA-256
+	ChecksumSHA256  = "sha256"
+	ChecksumBLAKE2b = "blake2b"
+	ChecksumBLAKE3  = "blake3"
+
+	// checksumHMACSHA256 fingerprints convergently encrypted blocks.
+	checksumHMACSHA256 = "hmac-sha256"
+)
+
+// DefaultChecksumAlgorithm is used when Configuration.ChecksumAlgorithm is
+// empty.
+const DefaultChecksumAlgorithm = ChecksumSHA256
+
+// getChecksumAlgorithm returns the algorithm new object versions should be
+// fingerprinted with.
+func (e *Engine) getChecksumAlgorithm() (string, error) {
+	if e.c.IsConvergentEncryptionEnabled {
+		return checksumHMACSHA256, nil
+	}
+
+	switch e.c.ChecksumAlgorithm {
+	case "":
+		return DefaultChecksumAlgorithm, nil
+	case ChecksumSHA1, ChecksumSHA256, ChecksumBLAKE2b, ChecksumBLAKE3:
+		return e.c.ChecksumAlgorithm, nil
+	}
+	return "", fmt.Errorf("Unknown checksum algorithm %s", e.c.ChecksumAlgorithm)
+}
+
+// computeChecksum returns the hex encoded fingerprint of p. For convergent
+// encryption this is an HMAC keyed by the repository's convergence secret, so
+// the database never holds a plain hash of the content.
+func (e *Engine) computeChecksum(algorithm string, p []byte) (string, error) {
+	switch algorithm {
+	case ChecksumSHA1:
+		hash, err := openssl.SHA1(p)
+		return hex.EncodeToString(hash[:]), err
+	case ChecksumSHA256:
+		hash, err := openssl.SHA256(p)
+		return hex.EncodeToString(hash[:]), err
+	case ChecksumBLAKE2b:
+		hash := blake2b.Sum256(p)
+		return hex.EncodeToString(hash[:]), nil
+	case ChecksumBLAKE3:
+		hash := blake3.Sum256(p)
+		return hex.EncodeToString(hash[:]), nil
+	case checksumHMACSHA256:
+		mac := hmac.New(sha256.New, e.convergenceSecret)
+		mac.Write(p)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	return "", fmt.Errorf("Unknown checksum algorithm %s", algorithm)
+}
+
+// migrateSHA1Checksums moves the checksums of repositories created before
+// the checksum algorithm was configurable into the generic columns.
+func migrateSHA1Checksums(db *gorm.DB) error {
+	if !db.Dialect().HasColumn("blocks", "sha1_checksum") {
+		return nil
+	}
+
+	err := db.Exec("UPDATE blocks SET checksum = sha1_checksum, "+
+		"checksum_algorithm = CASE WHEN is_convergent THEN ? ELSE ? END "+
+		"WHERE checksum IS NULL OR checksum = ''", checksumHMACSHA256, ChecksumSHA1).Error
+	if err != nil {
+		return err
+	}
+
+	return db.Exec("UPDATE object_versions SET checksum_algorithm = ? "+
+		"WHERE checksum_algorithm IS NULL OR checksum_algorithm = ''", ChecksumSHA1).Error
+}
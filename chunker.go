@@ -0,0 +1,218 @@
+package edis
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// chunker splits the input of a store into blocks.
+type chunker interface {
+	// next returns the next block of the input, read into buffer when
+	// possible, or io.EOF once the input is exhausted.
+	next(buffer []byte) ([]byte, error)
+}
+
+// fixedSizeChunker splits a file into blocks of blockSize bytes; only the
+// last block may be shorter.
+type fixedSizeChunker struct {
+	e              *Engine
+	file           *os.File
+	blockSize      int
+	numberOfBlocks int
+	blockNumber    int
+}
+
+func makeFixedSizeChunker(e *Engine, file *os.File, blockSize int) (*fixedSizeChunker, error) {
+	nBlocks, err := e.getNumBlocksInFile(file, blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(0, 0)
+	return &fixedSizeChunker{
+		e:              e,
+		file:           file,
+		blockSize:      blockSize,
+		numberOfBlocks: nBlocks,
+	}, err
+}
+
+func (c *fixedSizeChunker) next(buffer []byte) ([]byte, error) {
+	if c.blockNumber >= c.numberOfBlocks {
+		return nil, io.EOF
+	}
+
+	var err error
+	isBlockDefinitelyFull := c.blockNumber < c.numberOfBlocks-1
+	if isBlockDefinitelyFull {
+		_, err = c.file.Read(buffer)
+	} else {
+		buffer, err = c.e.getBlockInFile(c.file, c.blockSize, c.blockNumber)
+	}
+
+	c.blockNumber++
+	return buffer, err
+}
+
+// streamChunker splits a stream into blocks of the size of the buffers it is
+// given; only the last block may be shorter.
+type streamChunker struct {
+	source io.Reader
+	isEOF  bool
+}
+
+func makeStreamChunker(source io.Reader) *streamChunker {
+	return &streamChunker{source: source}
+}
+
+func (c *streamChunker) next(buffer []byte) ([]byte, error) {
+	if c.isEOF {
+		return nil, io.EOF
+	}
+
+	n, err := io.ReadFull(c.source, buffer)
+	if err == io.ErrUnexpectedEOF {
+		c.isEOF = true
+		return buffer[:n], nil
+	}
+	return buffer, err
+}
+
+// gearTable maps each byte to a pseudo-random value for the gear hash used by
+// contentDefinedChunker. It must never change, or chunk boundaries (and with
+// them deduplication against existing blocks) would change too.
+var gearTable = makeGearTable()
+
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6564697367656172) // "edisgear"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// contentDefinedChunker splits its input at boundaries chosen by a rolling
+// gear hash (FastCDC), so that inserting or deleting bytes only changes the
+// blocks around the edit.
+type contentDefinedChunker struct {
+	source      io.Reader
+	minSize     int
+	averageSize int
+	maxSize     int
+	maskS       uint64 // used before averageSize, makes cuts less likely
+	maskL       uint64 // used after averageSize, makes cuts more likely
+	window      []byte
+	start       int
+	end         int
+	isEOF       bool
+}
+
+func validateChunkSizes(minSize, averageSize, maxSize int) error {
+	if minSize < 64 || minSize >= averageSize || averageSize >= maxSize {
+		return fmt.Errorf("Chunk sizes must satisfy 64 <= min < average < max, got %d, %d and %d",
+			minSize, averageSize, maxSize)
+	}
+	return nil
+}
+
+func makeContentDefinedChunker(source io.Reader, minSize, averageSize, maxSize int) (*contentDefinedChunker, error) {
+	if err := validateChunkSizes(minSize, averageSize, maxSize); err != nil {
+		return nil, err
+	}
+
+	nBits := uint(bits.Len(uint(averageSize)) - 1)
+	return &contentDefinedChunker{
+		source:      source,
+		minSize:     minSize,
+		averageSize: averageSize,
+		maxSize:     maxSize,
+		maskS:       topBitsMask(nBits + 1),
+		maskL:       topBitsMask(nBits - 1),
+		window:      make([]byte, maxSize),
+	}, nil
+}
+
+// topBitsMask returns a mask of the n most significant bits. The gear hash
+// shifts left, so its top bits depend on the most bytes.
+func topBitsMask(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *contentDefinedChunker) next(buffer []byte) ([]byte, error) {
+	err := c.fill()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.window[c.start:c.end])
+	buffer = buffer[:n]
+	copy(buffer, c.window[c.start:c.start+n])
+	c.start += n
+	return buffer, nil
+}
+
+// fill makes sure the window holds at least maxSize bytes unless the source
+// is exhausted.
+func (c *contentDefinedChunker) fill() error {
+	if c.isEOF || c.end-c.start >= c.maxSize {
+		return nil
+	}
+
+	copy(c.window, c.window[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	n, err := io.ReadFull(c.source, c.window[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.isEOF = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the length of the chunk at the start of p.
+func (c *contentDefinedChunker) cut(p []byte) int {
+	n := len(p)
+	if n <= c.minSize {
+		return n
+	}
+
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+
+	normal := c.averageSize
+	if n < normal {
+		normal = n
+	}
+
+	var hash uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gearTable[p[i]]
+		if hash&c.maskS == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		hash = (hash << 1) + gearTable[p[i]]
+		if hash&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -1,19 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/tera-insights/edis"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func main() {
 	app := buildApp()
-	app.Run(os.Args)
+	err := app.Run(os.Args)
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
 func buildApp() *cli.App {
@@ -32,6 +43,19 @@ func buildApp() *cli.App {
 	app.Commands = []cli.Command{
 		buildStoreCommand(),
 		buildRetrieveCommand(),
+		buildKeyCommand(),
+		buildMountCommand(),
+		buildServeNBDCommand(),
+		buildMigrateCommand(),
+		buildRepackCommand(),
+		buildDeleteCommand(),
+		buildGCCommand(),
+		buildPruneCommand(),
+		buildVerifyCommand(),
+		buildScrubCommand(),
+		buildSyncCommand(),
+		buildExportCommand(),
+		buildImportCommand(),
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -54,12 +78,52 @@ func store(c *cli.Context) error {
 		return err
 	}
 
-	file, err := e.OpenFileForReading(inputPath)
+	// An interrupted store stops cleanly, removing the blocks it wrote.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	blockSize := c.Int("mbperblock") * 1024 * 1024
+	if inputPath == "-" {
+		err = e.SaveObjectFromReaderWithContext(ctx, os.Stdin, name, blockSize)
+	} else {
+		var file *os.File
+		file, err = e.OpenFileForReading(inputPath)
+		if err != nil {
+			return err
+		}
+		err = e.SaveObjectWithContext(ctx, file, name, blockSize)
+	}
+
+	if err != nil || c.String("compress") == edis.CodecNone {
+		return err
+	}
+
+	ov, err := e.GetLatestVersionNumber(name)
+	if err != nil {
+		return err
+	}
+
+	stats, err := e.GetCompressionStats(name, ov)
 	if err != nil {
 		return err
 	}
 
-	return e.SaveObject(file, name, c.Int("mbperblock")*1024*1024)
+	fmt.Printf("Stored %d bytes as %d bytes, compression ratio %.2f\n",
+		stats.UncompressedBytes, stats.StoredBytes, stats.Ratio())
+	if stats.ReusedBytes > 0 {
+		fmt.Printf("Reused %d bytes already stored\n", stats.ReusedBytes)
+	}
+	return nil
 }
 
 func retrieve(c *cli.Context) error {
@@ -68,20 +132,466 @@ func retrieve(c *cli.Context) error {
 		return err
 	}
 
+	if c.String("output") == "-" {
+		version := c.Int("version")
+		if c.Bool("latest") {
+			version, err = e.GetLatestVersionNumber(c.String("name"))
+			if err != nil {
+				return err
+			}
+		}
+		return e.RetrieveObjectTo(os.Stdout, c.String("name"), version)
+	}
+
 	if c.Bool("latest") {
 		return e.RetrieveLatestVersionOfObject(c.String("output"), c.String("name"))
 	}
 	return e.RetrieveObject(c.String("output"), c.String("name"), c.Int("version"))
 }
 
+func rotateKey(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	key, passphrase, err := readKeySource(c, "new-keyfile", "new-passphrase")
+	if err != nil {
+		return err
+	}
+
+	return e.RotateMasterKey(key, passphrase)
+}
+
+func mount(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	m, err := e.Mount(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		m.Unmount()
+	}()
+
+	return m.Wait()
+}
+
+func serveNBD(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	network, address := "tcp", c.String("listen")
+	if c.IsSet("socket") {
+		network, address = "unix", c.String("socket")
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(interrupted)
+		listener.Close()
+	}()
+
+	err = e.ServeNBD(listener, c.Bool("writable"), func(client net.Addr, err error) {
+		fmt.Fprintf(os.Stderr, "NBD connection from %v failed: %v\n", client, err)
+	})
+	select {
+	case <-interrupted:
+		return nil
+	default:
+		return err
+	}
+}
+
+func migrate(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	moved, err := e.MigrateToContentAddressedLayout()
+	fmt.Printf("Moved %d block files\n", moved)
+	return err
+}
+
+func repack(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	removed, err := e.Repack()
+	fmt.Printf("Removed %d packs\n", removed)
+	return err
+}
+
+func deleteObject(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("all") {
+		return e.DeleteObject(c.String("name"))
+	}
+	return e.DeleteObjectVersion(c.String("name"), c.Int("version"))
+}
+
+func collectGarbage(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	stats, err := e.CollectGarbage(c.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("dry-run") {
+		fmt.Printf("Would remove %d block files, reclaiming %d bytes\n", stats.Files, stats.Bytes)
+	} else {
+		fmt.Printf("Removed %d block files, reclaiming %d bytes\n", stats.Files, stats.Bytes)
+	}
+	return nil
+}
+
+func prune(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	isDryRun := c.Bool("dry-run")
+	var policies []edis.RetentionPolicy
+	if c.IsSet("keep-last") || c.IsSet("keep-daily") || c.IsSet("keep-weekly") || c.IsSet("keep-monthly") {
+		p := edis.RetentionPolicy{
+			Pattern:     c.String("name"),
+			KeepLast:    c.Int("keep-last"),
+			KeepDaily:   c.Int("keep-daily"),
+			KeepWeekly:  c.Int("keep-weekly"),
+			KeepMonthly: c.Int("keep-monthly"),
+		}
+		if c.Bool("save") && !isDryRun {
+			err = e.SetRetentionPolicy(p)
+			if err != nil {
+				return err
+			}
+		}
+		policies = []edis.RetentionPolicy{p}
+	} else {
+		policies, err = e.GetRetentionPolicies()
+		if err != nil {
+			return err
+		} else if len(policies) == 0 {
+			return fmt.Errorf("No retention policy was given or stored")
+		}
+	}
+
+	dropped, err := e.Prune(policies, isDryRun)
+	for _, ov := range dropped {
+		if isDryRun {
+			fmt.Printf("Would delete version %d of %s\n", ov.Version, ov.Name)
+		} else {
+			fmt.Printf("Deleted version %d of %s\n", ov.Version, ov.Name)
+		}
+	}
+	if err != nil || isDryRun || c.Bool("no-gc") {
+		return err
+	}
+
+	stats, err := e.CollectGarbage(false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %d block files, reclaiming %d bytes\n", stats.Files, stats.Bytes)
+	return nil
+}
+
+func verify(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := e.Verify(c.String("name"), c.Int("version"), c.Float64("sample"))
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.Unresolvable {
+		fmt.Printf("Unresolvable: %s\n", problem)
+	}
+	for _, problem := range report.Missing {
+		fmt.Printf("Missing: %s\n", problem)
+	}
+	for _, problem := range report.Corrupt {
+		fmt.Printf("Corrupt: %s\n", problem)
+	}
+	for _, key := range report.Orphaned {
+		fmt.Printf("Orphaned: %s\n", key)
+	}
+
+	fmt.Printf("Checked %d versions and read back %d block files\n", report.Versions, report.Files)
+	if !report.IsHealthy() {
+		return fmt.Errorf("Found %d unresolvable versions, %d missing blocks, %d corrupt blocks and %d orphaned files",
+			len(report.Unresolvable), len(report.Missing), len(report.Corrupt), len(report.Orphaned))
+	}
+	return nil
+}
+
+func scrub(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	report, err := e.Scrub(c.Bool("repair"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range report.Damaged {
+		fmt.Printf("Damaged: %s\n", file)
+	}
+	for _, file := range report.Repaired {
+		fmt.Printf("Repaired: %s\n", file)
+	}
+	for _, group := range report.Unrecoverable {
+		fmt.Printf("Unrecoverable: %s\n", group)
+	}
+
+	fmt.Printf("Checked %d parity groups\n", report.Groups)
+	if len(report.Damaged) != len(report.Repaired) {
+		return fmt.Errorf("%d damaged files were not repaired", len(report.Damaged)-len(report.Repaired))
+	}
+	return nil
+}
+
+func syncRepositories(c *cli.Context) error {
+	key, passphrase, err := readKeySource(c, "keyfile", "passphrase")
+	if err != nil {
+		return err
+	}
+
+	from, err := edis.MakeEngine(edis.Configuration{
+		DBPath:          c.String("from-db"),
+		StorageLocation: c.String("from-storage"),
+		MasterKey:       key,
+		Passphrase:      passphrase,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The destination uses the same master key unless told otherwise.
+	if c.IsSet("to-keyfile") || c.IsSet("to-passphrase") {
+		key, passphrase, err = readKeySource(c, "to-keyfile", "to-passphrase")
+		if err != nil {
+			return err
+		}
+	}
+
+	to, err := edis.MakeEngine(edis.Configuration{
+		DBPath:          c.String("to-db"),
+		StorageLocation: c.String("to-storage"),
+		MasterKey:       key,
+		Passphrase:      passphrase,
+		Compression:     c.String("compress"),
+	})
+	if err != nil {
+		return err
+	}
+
+	stats, err := from.SyncTo(&to, c.String("name"))
+	fmt.Printf("Copied %d versions, writing %d block files of %d bytes\n", stats.Versions, stats.Files, stats.Bytes)
+	return err
+}
+
+func exportObject(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	key, passphrase, err := readKeySource(c, "bundle-keyfile", "bundle-passphrase")
+	if err != nil {
+		return err
+	}
+
+	version := c.Int("version")
+	if c.Bool("latest") {
+		version, err = e.GetLatestVersionNumber(c.String("name"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.String("out") == "-" {
+		return e.ExportObjectVersion(os.Stdout, c.String("name"), version, c.Int("base"), key, passphrase)
+	}
+
+	out, err := os.Create(c.String("out"))
+	if err != nil {
+		return err
+	}
+
+	err = e.ExportObjectVersion(out, c.String("name"), version, c.Int("base"), key, passphrase)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func importObject(c *cli.Context) error {
+	e, err := makeEngineFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	key, passphrase, err := readKeySource(c, "bundle-keyfile", "bundle-passphrase")
+	if err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if c.String("input") != "-" {
+		in, err = os.Open(c.String("input"))
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	ov, stats, err := e.ImportObjectVersion(bufio.NewReader(in), c.String("name"), c.Int("base"), key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported version %d of %s, writing %d block files of %d bytes\n", ov.Version, ov.Name, stats.Files, stats.Bytes)
+	return nil
+}
+
+func makeSFTPBlockStoreFromContext(c *cli.Context) (edis.BlockStore, error) {
+	hostKeyCallback, err := knownhosts.New(c.String("sftp-known-hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var auth []ssh.AuthMethod
+	if c.IsSet("sftp-identity") {
+		p, err := ioutil.ReadFile(c.String("sftp-identity"))
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(p)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if c.IsSet("sftp-password") {
+		auth = append(auth, ssh.Password(c.String("sftp-password")))
+	}
+
+	return edis.MakeSFTPBlockStore(edis.SFTPConfiguration{
+		Address:   c.String("sftp-address"),
+		Directory: c.String("sftp-directory"),
+		SSH: &ssh.ClientConfig{
+			User:            c.String("sftp-user"),
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+		},
+		NumberOfConnections: c.Int("sftp-connections"),
+	})
+}
+
 func makeEngineFromContext(c *cli.Context) (edis.Engine, error) {
+	key, passphrase, err := readKeySource(c, "keyfile", "passphrase")
+	if err != nil {
+		return edis.Engine{}, err
+	}
+
+	var store edis.BlockStore
+	if c.IsSet("s3-bucket") {
+		store, err = edis.MakeS3BlockStore(edis.S3Configuration{
+			Bucket:      c.String("s3-bucket"),
+			Prefix:      c.String("s3-prefix"),
+			Endpoint:    c.String("s3-endpoint"),
+			Region:      c.String("s3-region"),
+			IsPathStyle: c.Bool("s3-path-style"),
+			PartSize:    int64(c.Int("s3-mbperpart")) * 1024 * 1024,
+			Concurrency: c.Int("s3-concurrency"),
+		})
+		if err != nil {
+			return edis.Engine{}, err
+		}
+	} else if c.IsSet("sftp-address") {
+		store, err = makeSFTPBlockStoreFromContext(c)
+		if err != nil {
+			return edis.Engine{}, err
+		}
+	}
+
 	return edis.MakeEngine(edis.Configuration{
+		BlockStore:        store,
+		NumberOfWriters:   c.Int("writers"),
 		DBPath:            c.String("db"),
 		StorageLocation:   c.String("storage"),
 		IsDirectIOEnabled: c.Bool("directio"),
+		MasterKey:         key,
+		Passphrase:        passphrase,
+
+		IsConvergentEncryptionEnabled: c.Bool("convergent"),
+		IsContentAddressed:            c.Bool("content-addressed"),
+		PackSize:                      c.Int("mbperpack") * 1024 * 1024,
+		DataShards:                    c.Int("data-shards"),
+		ParityShards:                  c.Int("parity-shards"),
+		ChecksumAlgorithm:             c.String("checksum"),
+		Compression:                   c.String("compress"),
+
+		IsContentDefinedChunkingEnabled: c.Bool("cdc"),
+		MinChunkSize:                    c.Int("minkbperchunk") * 1024,
+		AverageChunkSize:                c.Int("avgkbperchunk") * 1024,
+		MaxChunkSize:                    c.Int("maxkbperchunk") * 1024,
 	})
 }
 
+func readKeySource(c *cli.Context, keyfileFlag, passphraseFlag string) ([]byte, string, error) {
+	keyfile := c.String(keyfileFlag)
+	passphrase := c.String(passphraseFlag)
+	if keyfile == "" && passphrase == "" {
+		return []byte{}, passphrase, fmt.Errorf("Either '%s' or '%s' must be set", keyfileFlag, passphraseFlag)
+	}
+
+	if keyfile == "" {
+		return []byte{}, passphrase, nil
+	}
+
+	key, err := ioutil.ReadFile(keyfile)
+	return key, passphrase, err
+}
+
 func parseStoreFlags(c *cli.Context) (string, string, error) {
 	name := c.String("name")
 	input := c.String("input")
@@ -100,10 +610,34 @@ func getCommonSubcommandFlags() []cli.Flag {
 	return []cli.Flag{
 		cli.BoolFlag{Name: "directio", Usage: "If enabled, use directIO to read and write files"},
 		cli.StringFlag{Name: "db", Usage: "Path to the SQLite3 database that holds metadata about the backups"},
-		cli.StringFlag{Name: "storage", Usage: "Path to the directory to use for storage"},
+		cli.StringFlag{Name: "storage", Usage: "Path to the directory to use for storage. Either this, --s3-bucket or --sftp-address must be set"},
+		cli.StringFlag{Name: "s3-bucket", Usage: "S3 bucket to use for storage instead of a directory. Credentials are read from the environment or the shared AWS configuration"},
+		cli.StringFlag{Name: "s3-prefix", Usage: "Prefix of the keys of blocks in the S3 bucket"},
+		cli.StringFlag{Name: "s3-endpoint", Usage: "URL of an S3-compatible service such as MinIO or Ceph RGW. Defaults to AWS"},
+		cli.StringFlag{Name: "s3-region", Value: "us-east-1", EnvVar: "AWS_REGION", Usage: "Region of the S3 bucket"},
+		cli.BoolFlag{Name: "s3-path-style", Usage: "If enabled, address the S3 bucket in the path instead of the host name"},
+		cli.IntFlag{Name: "s3-mbperpart", Value: 5, Usage: "Blocks larger than this many megabytes are transferred to S3 in parts of this size"},
+		cli.IntFlag{Name: "s3-concurrency", Value: 5, Usage: "How many parts of a block are transferred to S3 at a time"},
+		cli.StringFlag{Name: "sftp-address", Usage: "host:port of an SSH server to use for storage instead of a directory"},
+		cli.StringFlag{Name: "sftp-directory", Value: "edis", Usage: "Directory on the SSH server to keep blocks in, relative to the home directory unless absolute"},
+		cli.StringFlag{Name: "sftp-user", EnvVar: "USER", Usage: "User to log into the SSH server as"},
+		cli.StringFlag{Name: "sftp-identity", Usage: "Path to a private key to log into the SSH server with"},
+		cli.StringFlag{Name: "sftp-password", EnvVar: "EDIS_SFTP_PASSWORD", Usage: "Password to log into the SSH server with"},
+		cli.StringFlag{Name: "sftp-known-hosts", Value: os.ExpandEnv("$HOME/.ssh/known_hosts"), Usage: "File listing the host key of the SSH server"},
+		cli.IntFlag{Name: "sftp-connections", Value: 4, Usage: "How many SSH connections to keep open"},
+		cli.IntFlag{Name: "writers", Value: 1, Usage: "How many blocks are stored in parallel"},
+		cli.StringFlag{Name: "keyfile", Usage: fmt.Sprintf("Path to a file containing the %d-byte master key. Either this or --passphrase must be set", edis.KeySizeInBytes)},
+		cli.StringFlag{Name: "passphrase", EnvVar: "EDIS_PASSPHRASE", Usage: "Passphrase from which the master key is derived. Either this or --keyfile must be set"},
 	}
 }
 
+// isFlagSet reports whether a required flag was given. Blocks can be stored
+// in S3 or over SFTP instead of a directory.
+func isFlagSet(c *cli.Context, flag string) bool {
+	isRemote := c.IsSet("s3-bucket") || c.IsSet("sftp-address")
+	return c.IsSet(flag) || (flag == "storage" && isRemote)
+}
+
 func buildRequiredFlagText(flags []string) string {
 	s := ""
 	for _, f := range flags {
@@ -121,8 +655,19 @@ func buildStoreCommand() cli.Command {
 		Usage: "Store a version of a binary",
 		Flags: append([]cli.Flag{
 			cli.StringFlag{Name: "name", Usage: "The name of the object to store"},
-			cli.StringFlag{Name: "input", Usage: "Path to the file to read"},
+			cli.StringFlag{Name: "input", Usage: "Path to the file to read, or - to read from standard input"},
 			cli.IntFlag{Name: "mbperblock", Value: 10, Usage: "How many megabytes are in a block. Must be an integer"},
+			cli.StringFlag{Name: "compress", Value: edis.CodecNone, Usage: "Codec used to compress blocks before encrypting them: zstd, lz4 or none"},
+			cli.BoolFlag{Name: "cdc", Usage: "If enabled, split the input at content-defined boundaries instead of every --mbperblock megabytes"},
+			cli.IntFlag{Name: "minkbperchunk", Value: 256, Usage: "Minimum size of a content-defined chunk in kilobytes"},
+			cli.IntFlag{Name: "avgkbperchunk", Value: 1024, Usage: "Average size of a content-defined chunk in kilobytes"},
+			cli.IntFlag{Name: "maxkbperchunk", Value: 4096, Usage: "Maximum size of a content-defined chunk in kilobytes"},
+			cli.StringFlag{Name: "checksum", Value: edis.DefaultChecksumAlgorithm, Usage: "Algorithm used to fingerprint blocks: sha256, blake2b or blake3"},
+			cli.BoolFlag{Name: "convergent", Usage: "If enabled, derive block keys from their content so identical blocks are stored once without storing plaintext hashes"},
+			cli.BoolFlag{Name: "content-addressed", Usage: "If enabled, name new block files after their content in fanned-out directories"},
+			cli.IntFlag{Name: "mbperpack", Usage: "If not 0, append new blocks to pack files of about this many megabytes instead of giving each a file of its own"},
+			cli.IntFlag{Name: "data-shards", Value: 10, Usage: "How many new block files are protected by each group of --parity-shards parity files"},
+			cli.IntFlag{Name: "parity-shards", Usage: "If not 0, store this many parity files for every --data-shards new block files, so that scrub can rebuild as many of them"},
 		}, getCommonSubcommandFlags()...),
 		SkipFlagParsing: false,
 		HideHelp:        false,
@@ -130,7 +675,7 @@ func buildStoreCommand() cli.Command {
 		UsageText:       usageText,
 		Action: func(c *cli.Context) error {
 			for _, flag := range requiredFlags {
-				if !c.IsSet(flag) {
+				if !isFlagSet(c, flag) {
 					err := fmt.Errorf("Required option \"%s\" is missing", flag)
 					fmt.Println(err)
 					fmt.Println("Usage: " + usageText)
@@ -159,30 +704,515 @@ func buildRetrieveCommand() cli.Command {
 		Flags: append([]cli.Flag{
 			cli.StringFlag{Name: "name", Usage: "The name of the object to retrieve"},
 			cli.IntFlag{Name: "version", Value: 1, Usage: "Specify an object version to retrieve. Either this or --latest must be set"},
-			cli.StringFlag{Name: "output", Usage: "Path into which the retrieved object should be written"},
+			cli.StringFlag{Name: "output", Usage: "Path into which the retrieved object should be written, or - to write it to standard output"},
 			cli.BoolFlag{Name: "latest", Usage: "If enabled, fetch the latest version. Either this or --version must be set"},
 		}, getCommonSubcommandFlags()...),
 		SkipFlagParsing: false,
 		HideHelp:        false,
 		Hidden:          false,
 		Action: func(c *cli.Context) error {
+			// Keep messages out of the retrieved object when it goes to stdout.
+			out := os.Stdout
+			if c.String("output") == "-" {
+				out = os.Stderr
+			}
+
 			for _, flag := range requiredFlags {
-				if !c.IsSet(flag) {
+				if !isFlagSet(c, flag) {
 					err := fmt.Errorf("Required option \"%s\" is missing", flag)
-					fmt.Println(err)
-					fmt.Println("Usage: " + usageText)
+					fmt.Fprintln(out, err)
+					fmt.Fprintln(out, "Usage: "+usageText)
 					return err
 				}
 			}
 
 			if !c.IsSet("latest") && !c.IsSet("version") {
 				err := fmt.Errorf("Neither \"latest\" nor \"version\" was set")
-				fmt.Println(err)
-				fmt.Println("Usage: " + usageText)
+				fmt.Fprintln(out, err)
+				fmt.Fprintln(out, "Usage: "+usageText)
 				return err
 			}
 
 			err := retrieve(c)
+			if err != nil {
+				fmt.Fprintf(out, "Error = %v\n", err)
+				fmt.Fprintln(out, "Usage: "+usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildKeyCommand() cli.Command {
+	return cli.Command{
+		Name:  "key",
+		Usage: "Manage the master key of a repository",
+		Subcommands: cli.Commands{
+			buildKeyRotateCommand(),
+		},
+	}
+}
+
+func buildKeyRotateCommand() cli.Command {
+	requiredFlags := []string{"db"}
+	usageText := "\nedis key rotate " + buildRequiredFlagText(requiredFlags) + " --keyfile $KEYFILE --new-keyfile $NEW_KEYFILE" +
+		"\nEDIS_PASSPHRASE=... EDIS_NEW_PASSPHRASE=... edis key rotate " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "rotate",
+		Usage:     "Re-wrap all data keys under a new master key without rewriting any blocks",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{Name: "new-keyfile", Usage: "Path to a file containing the new master key. Either this or --new-passphrase must be set"},
+			cli.StringFlag{Name: "new-passphrase", EnvVar: "EDIS_NEW_PASSPHRASE", Usage: "Passphrase from which the new master key is derived. Either this or --new-keyfile must be set"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := rotateKey(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildMountCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis mount " + buildRequiredFlagText(requiredFlags) + " $MOUNTPOINT"
+
+	return cli.Command{
+		Name:      "mount",
+		Usage:     "Mount the stored objects as a read-only filesystem until interrupted",
+		UsageText: usageText,
+		Flags:     getCommonSubcommandFlags(),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			if c.NArg() != 1 {
+				err := fmt.Errorf("Expected exactly one mountpoint, got %d arguments", c.NArg())
+				fmt.Println(err)
+				fmt.Println("Usage: " + usageText)
+				return err
+			}
+
+			err := mount(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildServeNBDCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis serve-nbd " + buildRequiredFlagText(requiredFlags) + " --listen $ADDRESS" +
+		"\nedis serve-nbd " + buildRequiredFlagText(requiredFlags) + " --socket $SOCKET_PATH"
+
+	return cli.Command{
+		Name:      "serve-nbd",
+		Usage:     "Export object versions over the Network Block Device protocol until interrupted",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{Name: "listen", Value: "localhost:10809", Usage: "TCP address to listen on"},
+			cli.StringFlag{Name: "socket", Usage: "Path of a Unix socket to listen on instead of --listen"},
+			cli.BoolFlag{Name: "writable", Usage: "If enabled, OBJECT/latest accepts writes, which are saved as a new version when the client disconnects"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := serveNBD(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildMigrateCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis migrate " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "migrate",
+		Usage:     "Move existing block files to the content-addressed layout. Must not run while objects are being stored",
+		UsageText: usageText,
+		Flags:     getCommonSubcommandFlags(),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := migrate(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildRepackCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis repack " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "repack",
+		Usage:     "Consolidate packs that are small or mostly unused. Must not run while objects are being stored",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.IntFlag{Name: "mbperpack", Value: edis.DefaultPackSize / 1024 / 1024, Usage: "Size of the packs to write in megabytes"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := repack(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildDeleteCommand() cli.Command {
+	requiredFlags := []string{"name", "db", "storage"}
+	usageText := "\nedis delete --all " + buildRequiredFlagText(requiredFlags) + "\nedis delete --version $VERSION " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "delete",
+		Usage:     "Delete a version of an object, or all of them. Run gc afterwards to remove block files",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{Name: "name", Usage: "The name of the object to delete"},
+			cli.IntFlag{Name: "version", Usage: "The version to delete. Either this or --all must be set"},
+			cli.BoolFlag{Name: "all", Usage: "If enabled, delete every version. Either this or --version must be set"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			if c.IsSet("all") == c.IsSet("version") {
+				err := fmt.Errorf("Exactly one of \"all\" and \"version\" must be set")
+				fmt.Println(err)
+				fmt.Println("Usage: " + usageText)
+				return err
+			}
+
+			err := deleteObject(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildGCCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis gc " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "gc",
+		Usage:     "Remove block files no remaining version uses. Must not run while repacking",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.BoolFlag{Name: "dry-run", Usage: "If enabled, only report how much space would be reclaimed"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := collectGarbage(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildPruneCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis prune " + buildRequiredFlagText(requiredFlags) + "\nedis prune --keep-daily 7 --keep-weekly 4 [--name $PATTERN] [--save] [--no-gc] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "prune",
+		Usage:     "Delete versions a retention policy does not keep, then remove unused block files. Without --keep-* flags, the stored policies are applied",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{Name: "name", Usage: "Pattern of the names of the objects the policy applies to, such as images/*. Defaults to every object"},
+			cli.IntFlag{Name: "keep-last", Usage: "Keep this many of the newest versions"},
+			cli.IntFlag{Name: "keep-daily", Usage: "Keep the newest version of each of this many of the last days with one"},
+			cli.IntFlag{Name: "keep-weekly", Usage: "Keep the newest version of each of this many of the last weeks with one"},
+			cli.IntFlag{Name: "keep-monthly", Usage: "Keep the newest version of each of this many of the last months with one"},
+			cli.BoolFlag{Name: "save", Usage: "If enabled, store the policy so later runs without --keep-* flags apply it"},
+			cli.BoolFlag{Name: "dry-run", Usage: "If enabled, only report which versions would be deleted"},
+			cli.BoolFlag{Name: "no-gc", Usage: "If enabled, leave unused block files for a later gc"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := prune(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildVerifyCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis verify [--name $OBJECT_NAME [--version $VERSION]] [--sample $PERCENT] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "verify",
+		Usage:     "Check that stored versions can be retrieved, exiting with a non-zero status if any cannot",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{Name: "name", Usage: "The name of the object to check. If not set, every object is checked and unused block files are reported"},
+			cli.IntFlag{Name: "version", Usage: "The version to check. If not set, every version is checked"},
+			cli.Float64Flag{Name: "sample", Value: 100, Usage: "Percentage of block files to read back and check against their checksums"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			if c.IsSet("version") && !c.IsSet("name") {
+				err := fmt.Errorf("\"version\" can only be set along with \"name\"")
+				fmt.Println(err)
+				fmt.Println("Usage: " + usageText)
+				return err
+			}
+
+			err := verify(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+			}
+			return err
+		},
+	}
+}
+
+func buildScrubCommand() cli.Command {
+	requiredFlags := []string{"db", "storage"}
+	usageText := "\nedis scrub [--repair] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "scrub",
+		Usage:     "Check block files protected by parity files, exiting with a non-zero status if any are damaged and not repaired",
+		UsageText: usageText,
+		Flags: append([]cli.Flag{
+			cli.BoolFlag{Name: "repair", Usage: "If enabled, rebuild damaged files from the rest of their parity group"},
+		}, getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := scrub(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+			}
+			return err
+		},
+	}
+}
+
+func buildSyncCommand() cli.Command {
+	requiredFlags := []string{"from-db", "from-storage", "to-db", "to-storage"}
+	usageText := "\nedis sync [--name $OBJECT_NAME] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "sync",
+		Usage:     "Copy versions missing from another repository into it. Can be run again to resume",
+		UsageText: usageText,
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "from-db", Usage: "Path to the SQLite3 database of the repository to copy from"},
+			cli.StringFlag{Name: "from-storage", Usage: "Path to the storage directory of the repository to copy from"},
+			cli.StringFlag{Name: "to-db", Usage: "Path to the SQLite3 database of the repository to copy to, which is created if needed"},
+			cli.StringFlag{Name: "to-storage", Usage: "Path to the storage directory of the repository to copy to"},
+			cli.StringFlag{Name: "name", Usage: "The name of the object to copy. If not set, every object is copied"},
+			cli.StringFlag{Name: "compress", Value: edis.CodecNone, Usage: "Codec used to compress blocks copied to the destination: zstd, lz4 or none"},
+			cli.StringFlag{Name: "keyfile", Usage: fmt.Sprintf("Path to a file containing the %d-byte master key of the source. Either this or --passphrase must be set", edis.KeySizeInBytes)},
+			cli.StringFlag{Name: "passphrase", EnvVar: "EDIS_PASSPHRASE", Usage: "Passphrase from which the master key of the source is derived. Either this or --keyfile must be set"},
+			cli.StringFlag{Name: "to-keyfile", Usage: "Path to a file containing the master key of the destination, if it differs from the source's"},
+			cli.StringFlag{Name: "to-passphrase", EnvVar: "EDIS_TO_PASSPHRASE", Usage: "Passphrase from which the master key of the destination is derived, if it differs from the source's"},
+		},
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !c.IsSet(flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := syncRepositories(c)
+			if err != nil {
+				fmt.Printf("Error = %v\n", err)
+				fmt.Println("Usage: " + usageText)
+			}
+			return err
+		},
+	}
+}
+
+func getBundleKeyFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "bundle-keyfile", Usage: fmt.Sprintf("Path to a file containing the %d-byte key of the bundle. Either this or --bundle-passphrase must be set", edis.KeySizeInBytes)},
+		cli.StringFlag{Name: "bundle-passphrase", EnvVar: "EDIS_BUNDLE_PASSPHRASE", Usage: "Passphrase from which the key of the bundle is derived. Either this or --bundle-keyfile must be set"},
+	}
+}
+
+func buildExportCommand() cli.Command {
+	requiredFlags := []string{"name", "out", "db", "storage"}
+	usageText := "\nedis export --latest [--base $VERSION] " + buildRequiredFlagText(requiredFlags) + "\nedis export --version $VERSION [--base $VERSION] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "export",
+		Usage:     "Write a version of an object to a self-contained, encrypted bundle",
+		UsageText: usageText,
+		Flags: append(append([]cli.Flag{
+			cli.StringFlag{Name: "name", Usage: "The name of the object to export"},
+			cli.IntFlag{Name: "version", Usage: "The version to export. Either this or --latest must be set"},
+			cli.BoolFlag{Name: "latest", Usage: "If enabled, export the latest version. Either this or --version must be set"},
+			cli.IntFlag{Name: "base", Usage: "If set, leave out blocks this version also has. The bundle can then only be imported where that version is"},
+			cli.StringFlag{Name: "out", Usage: "Path of the bundle to write, or - to write it to standard output"},
+		}, getBundleKeyFlags()...), getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			// Keep messages out of the bundle when it goes to stdout.
+			out := os.Stdout
+			if c.String("out") == "-" {
+				out = os.Stderr
+			}
+
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Fprintln(out, err)
+					fmt.Fprintln(out, "Usage: "+usageText)
+					return err
+				}
+			}
+
+			if c.IsSet("latest") == c.IsSet("version") {
+				err := fmt.Errorf("Exactly one of \"latest\" and \"version\" must be set")
+				fmt.Fprintln(out, err)
+				fmt.Fprintln(out, "Usage: "+usageText)
+				return err
+			}
+
+			err := exportObject(c)
+			if err != nil {
+				fmt.Fprintf(out, "Error = %v\n", err)
+				fmt.Fprintln(out, "Usage: "+usageText)
+			}
+			return err
+		},
+	}
+}
+
+func buildImportCommand() cli.Command {
+	requiredFlags := []string{"input", "db", "storage"}
+	usageText := "\nedis import [--name $OBJECT_NAME] [--base $VERSION] " + buildRequiredFlagText(requiredFlags)
+
+	return cli.Command{
+		Name:      "import",
+		Usage:     "Add the version of an object in a bundle as a new version",
+		UsageText: usageText,
+		Flags: append(append([]cli.Flag{
+			cli.StringFlag{Name: "input", Usage: "Path of the bundle to read, or - to read it from standard input"},
+			cli.StringFlag{Name: "name", Usage: "The name to import the object as. Defaults to the name it was exported with"},
+			cli.IntFlag{Name: "base", Usage: "The version holding the blocks a bundle exported with --base left out. Defaults to the latest version"},
+		}, getBundleKeyFlags()...), getCommonSubcommandFlags()...),
+		Action: func(c *cli.Context) error {
+			for _, flag := range requiredFlags {
+				if !isFlagSet(c, flag) {
+					err := fmt.Errorf("Required option \"%s\" is missing", flag)
+					fmt.Println(err)
+					fmt.Println("Usage: " + usageText)
+					return err
+				}
+			}
+
+			err := importObject(c)
 			if err != nil {
 				fmt.Printf("Error = %v\n", err)
 				fmt.Println("Usage: " + usageText)
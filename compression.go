@@ -0,0 +1,159 @@
+package edis
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Codecs that blocks can be compressed with before they are encrypted.
+const (
+	CodecNone = "none"
+	CodecZstd = "zstd"
+	CodecLZ4  = "lz4"
+)
+
+const lz4HashTableSize = 1 << 16
+
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdErr error
+
+func loadZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// getCompressionCodec returns the codec new blocks should be compressed with.
+func (e *Engine) getCompressionCodec() (string, error) {
+	switch e.c.Compression {
+	case "", CodecNone:
+		return CodecNone, nil
+	case CodecZstd, CodecLZ4:
+		if e.c.IsDirectIOEnabled {
+			return "", fmt.Errorf("DirectIO cannot be used with compression")
+		}
+		return e.c.Compression, nil
+	}
+	return "", fmt.Errorf("Unknown compression codec %s", e.c.Compression)
+}
+
+// compress compresses p with codec. If that does not make p any smaller, p
+// is returned as is along with CodecNone.
+func compress(codec string, p []byte) ([]byte, string, error) {
+	var compressed []byte
+	switch codec {
+	case CodecNone:
+		return p, CodecNone, nil
+	case CodecZstd:
+		if err := loadZstd(); err != nil {
+			return p, CodecNone, err
+		}
+		compressed = zstdEncoder.EncodeAll(p, make([]byte, 0, len(p)))
+	case CodecLZ4:
+		compressed = make([]byte, lz4.CompressBlockBound(len(p)))
+		n, err := lz4.CompressBlock(p, compressed, make([]int, lz4HashTableSize))
+		if err != nil {
+			return p, CodecNone, err
+		}
+		compressed = compressed[:n]
+	default:
+		return p, CodecNone, fmt.Errorf("Unknown compression codec %s", codec)
+	}
+
+	isIncompressible := len(compressed) == 0 || len(compressed) >= len(p)
+	if isIncompressible {
+		return p, CodecNone, nil
+	}
+	return compressed, codec, nil
+}
+
+// decompress inflates p, which was compressed with codec from
+// uncompressedLength bytes.
+func decompress(codec string, p []byte, uncompressedLength int) ([]byte, error) {
+	var inflated []byte
+	var err error
+	switch codec {
+	case "", CodecNone:
+		return p, nil
+	case CodecZstd:
+		if err = loadZstd(); err != nil {
+			return []byte{}, err
+		}
+		inflated, err = zstdDecoder.DecodeAll(p, make([]byte, 0, uncompressedLength))
+	case CodecLZ4:
+		inflated = make([]byte, uncompressedLength)
+		var n int
+		n, err = lz4.UncompressBlock(p, inflated)
+		inflated = inflated[:n]
+	default:
+		return []byte{}, fmt.Errorf("Unknown compression codec %s", codec)
+	}
+
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(inflated) != uncompressedLength {
+		return []byte{}, fmt.Errorf("Block decompressed to %d bytes instead of %d", len(inflated), uncompressedLength)
+	}
+	return inflated, nil
+}
+
+// CompressionStats describes how well the blocks stored for an object version
+// compressed.
+type CompressionStats struct {
+	UncompressedBytes int64 // of the blocks whose files were written for the version
+	StoredBytes       int64
+	ReusedBytes       int64 // of the blocks that use files stored before
+}
+
+// Ratio returns how many times smaller the stored blocks are than their
+// content.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.UncompressedBytes) / float64(s.StoredBytes)
+}
+
+// GetCompressionStats summarizes the blocks that were stored for a particular
+// object version, not counting those inherited from earlier versions or
+// holes. A file is counted for the first block recorded as using it, and the
+// other blocks using it count as reused.
+func (e *Engine) GetCompressionStats(name string, version int) (CompressionStats, error) {
+	var blocks []Block
+	err := e.db.Find(&blocks, "object_name = ? AND version = ? AND is_hole = ?", name, version, false).Error
+	if err != nil {
+		return CompressionStats{}, err
+	}
+
+	var written []Block
+	err = e.db.Raw("SELECT * FROM blocks b WHERE object_name = ? AND version = ? AND is_hole = ? "+
+		"AND NOT EXISTS (SELECT 1 FROM blocks o WHERE o.location = b.location "+
+		"AND o.pack_offset = b.pack_offset AND o.rowid < b.rowid)", name, version, false).Scan(&written).Error
+	if err != nil {
+		return CompressionStats{}, err
+	}
+
+	stats := CompressionStats{}
+	for i := 0; i < len(blocks); i++ {
+		stats.ReusedBytes += int64(blocks[i].ByteLength)
+	}
+
+	for i := 0; i < len(written); i++ {
+		stats.UncompressedBytes += int64(written[i].ByteLength)
+		stats.StoredBytes += int64(written[i].StoredLength)
+		stats.ReusedBytes -= int64(written[i].ByteLength)
+	}
+	return stats, nil
+}
@@ -0,0 +1,66 @@
+package edis
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+var convergentKeyLabel = []byte("edis convergent block key")
+
+// deriveConvergentKey derives the key of a convergently encrypted block from
+// its keyed fingerprint. Identical blocks therefore share a key, but the key
+// cannot be recovered without the convergence secret.
+func deriveConvergentKey(secret []byte, fingerprint string) ([]byte, error) {
+	p, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Invalid fingerprint %s for convergent block: %v", fingerprint, err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(convergentKeyLabel)
+	mac.Write(p)
+	return mac.Sum(nil), nil
+}
+
+// getKeyForBlock returns the key that encrypts the file backing b.
+func (e *Engine) getKeyForBlock(b Block) ([]byte, error) {
+	if b.IsConvergent {
+		return deriveConvergentKey(e.convergenceSecret, b.Checksum)
+	}
+	return e.loadDataKey(b.DataKeyID)
+}
+
+// loadConvergenceSecret unwraps the repository's convergence secret, creating
+// it the first time it is needed.
+func (e *Engine) loadConvergenceSecret() ([]byte, error) {
+	var info MasterKeyInfo
+	err := e.db.First(&info).Error
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(info.ConvergenceSecret) != 0 {
+		return decryptBlock(e.master, info.ConvergenceSecret, info.ConvergenceSecretNonce, info.ConvergenceSecretTag)
+	}
+
+	secret := make([]byte, KeySizeInBytes)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	err = wrapConvergenceSecret(&info, e.master, secret)
+	if err != nil {
+		return []byte{}, err
+	}
+	return secret, e.db.Save(&info).Error
+}
+
+func wrapConvergenceSecret(info *MasterKeyInfo, master, secret []byte) error {
+	var err error
+	info.ConvergenceSecret, info.ConvergenceSecretNonce, info.ConvergenceSecretTag, err = encryptBlock(master, secret)
+	return err
+}
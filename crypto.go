@@ -0,0 +1,75 @@
+package edis
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/spacemonkeygo/openssl"
+)
+
+// KeySizeInBytes is the size of the AES-256 master and data keys.
+const KeySizeInBytes = 32
+
+const keySizeInBits = KeySizeInBytes * 8
+const nonceSizeInBytes = 12
+
+// encryptBlock seals p with AES-256-GCM under a freshly generated nonce. The
+// ciphertext has the same length as p; the nonce and authentication tag are
+// returned separately so they can be stored alongside the block's row.
+func encryptBlock(key, p []byte) (ciphertext, nonce, tag []byte, err error) {
+	nonce = make([]byte, nonceSizeInBytes)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	ctx, err := openssl.NewGCMEncryptionCipherCtx(keySizeInBits, nil, key, nonce)
+	if err != nil {
+		return
+	}
+
+	ciphertext, err = ctx.EncryptUpdate(p)
+	if err != nil {
+		return
+	}
+
+	final, err := ctx.EncryptFinal()
+	if err != nil {
+		return
+	}
+	ciphertext = append(ciphertext, final...)
+
+	tag, err = ctx.GetTag()
+	return
+}
+
+// decryptBlock opens a ciphertext produced by encryptBlock. It returns an
+// error if the authentication tag does not match, which means either the
+// block file or its metadata has been tampered with.
+func decryptBlock(key, ciphertext, nonce, tag []byte) ([]byte, error) {
+	if len(nonce) != nonceSizeInBytes {
+		return []byte{}, fmt.Errorf("Block has an invalid nonce of length %d", len(nonce))
+	}
+
+	ctx, err := openssl.NewGCMDecryptionCipherCtx(keySizeInBits, nil, key, nonce)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	p, err := ctx.DecryptUpdate(ciphertext)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	err = ctx.SetTag(tag)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	final, err := ctx.DecryptFinal()
+	if err != nil {
+		return []byte{}, fmt.Errorf("Block failed authentication: %v", err)
+	}
+
+	return append(p, final...), nil
+}
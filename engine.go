@@ -1,10 +1,12 @@
 package edis
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math"
 	"os"
-	"path"
+	"sort"
 	"strconv"
 
 	"github.com/ncw/directio"
@@ -16,14 +18,65 @@ import (
 // Configuration defines the paths and variables needed to run edis.
 type Configuration struct {
 	DBPath            string
-	StorageLocation   string
+	StorageLocation   string // directory blocks are stored in unless BlockStore is set
 	IsDirectIOEnabled bool
+	MasterKey         []byte // AES-256 key that wraps the data keys
+	Passphrase        string // used to derive the master key instead of MasterKey
+
+	// IsConvergentEncryptionEnabled makes new blocks use keys derived from
+	// their content, so identical blocks are stored once without the
+	// database holding plaintext hashes.
+	IsConvergentEncryptionEnabled bool
+
+	// ChecksumAlgorithm fingerprints the blocks of new object versions. It is
+	// ignored with convergent encryption, which always uses HMAC-SHA256.
+	ChecksumAlgorithm string
+
+	// IsContentDefinedChunkingEnabled splits new object versions at
+	// boundaries chosen by a rolling hash of their content instead of at
+	// fixed offsets, so inserted or deleted bytes only affect nearby blocks.
+	IsContentDefinedChunkingEnabled bool
+	MinChunkSize                    int
+	AverageChunkSize                int
+	MaxChunkSize                    int
+
+	// Compression is the codec blocks are compressed with before they are
+	// encrypted: CodecNone, CodecZstd or CodecLZ4.
+	Compression string
+
+	// BlockStore holds the files of blocks. If nil, they are kept under
+	// StorageLocation.
+	BlockStore BlockStore
+
+	// NumberOfWriters is how many blocks are stored in parallel. Defaults
+	// to 1.
+	NumberOfWriters int
+
+	// IsContentAddressed names new block files after their content, in
+	// fanned-out directories, instead of after the object version and index
+	// they were first stored for.
+	IsContentAddressed bool
+
+	// PackSize, if not 0, makes new blocks be appended to pack files of
+	// about this many bytes instead of each getting a file of its own.
+	PackSize int
+
+	// ParityShards, if not 0, makes every DataShards new block files of an
+	// object version be protected by ParityShards parity files, so that
+	// Scrub can rebuild up to ParityShards of them. Packs cannot be
+	// protected.
+	DataShards   int
+	ParityShards int
 }
 
 // Engine interacts with the database.
 type Engine struct {
-	db *gorm.DB
-	c  Configuration
+	db                *gorm.DB
+	c                 Configuration
+	master            []byte
+	convergenceSecret []byte
+	dataKeys          *dataKeyCache
+	store             BlockStore
 }
 
 // MakeEngine onnects to the specified DB and runs the `AutoMigrate` steps.
@@ -38,11 +91,59 @@ func MakeEngine(c Configuration) (Engine, error) {
 		return Engine{}, err
 	}
 
+	isPlaintextUnmarked := db.HasTable(Block{}) && !db.Dialect().HasColumn("blocks", "is_plaintext")
 	err = db.AutoMigrate(Block{}).Error
-	return Engine{
-		db: db,
-		c:  c,
-	}, err
+	if err != nil {
+		return Engine{}, err
+	}
+
+	if isPlaintextUnmarked {
+		err = markPlaintextBlocks(db)
+		if err != nil {
+			return Engine{}, err
+		}
+	}
+
+	err = migrateSHA1Checksums(db)
+	if err != nil {
+		return Engine{}, err
+	}
+
+	err = migrateCreationTimes(db)
+	if err != nil {
+		return Engine{}, err
+	}
+
+	err = db.AutoMigrate(DataKey{}, MasterKeyInfo{}, Pack{}, RetentionPolicy{}, ParityGroup{}, ParityShard{},
+		PendingStore{}, StagedFile{}).Error
+	if err != nil {
+		return Engine{}, err
+	}
+
+	e := Engine{
+		db:       db,
+		c:        c,
+		dataKeys: makeDataKeyCache(),
+		store:    c.BlockStore,
+	}
+	if e.store == nil {
+		e.store = MakeLocalBlockStore(c.StorageLocation, c.IsDirectIOEnabled)
+		err = migrateAbsoluteLocations(db, c.StorageLocation)
+		if err != nil {
+			return e, err
+		}
+	}
+
+	e.master, err = e.loadMasterKey(c.MasterKey, c.Passphrase)
+	if err != nil {
+		return e, err
+	}
+
+	e.convergenceSecret, err = e.loadConvergenceSecret()
+	if err != nil {
+		return e, err
+	}
+	return e, e.recoverIncompleteStores()
 }
 
 func (e *Engine) getObjectVersion(name string, version int) (ObjectVersion, error) {
@@ -79,7 +180,7 @@ func getLatestBlocks(ov ObjectVersion, all []Block) ([]Block, error) {
 		}
 
 		old := latest[current.BlockIndex]
-		isNewer := old == Block{} || old.Version < current.Version
+		isNewer := !written[current.BlockIndex] || old.Version < current.Version
 		if isNewer {
 			latest[current.BlockIndex] = current
 			written[current.BlockIndex] = true
@@ -118,6 +219,50 @@ func (e *Engine) loadLatestBlock(name string, index int) (Block, error) {
 	return latest, nil
 }
 
+// getObjectNames returns the sorted names of all stored objects.
+func (e *Engine) getObjectNames() ([]string, error) {
+	var all []ObjectVersion
+	err := e.db.Find(&all).Error
+	if err != nil {
+		return []string{}, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for i := 0; i < len(all); i++ {
+		if !seen[all[i].Name] {
+			seen[all[i].Name] = true
+			names = append(names, all[i].Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getObjectVersions returns every version of the object with the given name,
+// oldest first.
+func (e *Engine) getObjectVersions(name string) ([]ObjectVersion, error) {
+	var found []ObjectVersion
+	err := e.db.Find(&found, &ObjectVersion{
+		Name: name,
+	}).Error
+	if err != nil {
+		return []ObjectVersion{}, err
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Version < found[j].Version
+	})
+	return found, nil
+}
+
+// GetLatestVersionNumber returns the latest version number of the object with
+// the given name.
+func (e *Engine) GetLatestVersionNumber(name string) (int, error) {
+	ov, err := e.getLatestVersion(name)
+	return ov.Version, err
+}
+
 func (e *Engine) getLatestVersion(name string) (ObjectVersion, error) {
 	var found []ObjectVersion
 	err := e.db.Model(&ObjectVersion{}).Find(&found, &ObjectVersion{
@@ -185,7 +330,9 @@ func (e *Engine) isObjectNew(name string) (bool, error) {
 	return count == 0, err
 }
 
-func (e *Engine) isBlockNew(ov ObjectVersion, blockIndex int, newBlockChecksum string) (bool, error) {
+// isBlockNew reports whether candidate, a block of ov, differs from the block
+// at the same index in the latest stored version of the object.
+func (e *Engine) isBlockNew(ov ObjectVersion, candidate Block) (bool, error) {
 	isObjectNew, err := e.isObjectNew(ov.Name)
 	if err != nil {
 		return false, err
@@ -200,34 +347,54 @@ func (e *Engine) isBlockNew(ov ObjectVersion, blockIndex int, newBlockChecksum s
 		return false, err
 	}
 
-	isBlockNew := blockIndex >= latestVersion.NumberOfBlocks
+	isBlockNew := candidate.BlockIndex >= latestVersion.NumberOfBlocks
 	if isBlockNew {
 		return true, nil
 	}
 
-	latestBlock, err := e.loadLatestBlock(ov.Name, blockIndex)
+	latestBlock, err := e.loadLatestBlock(ov.Name, candidate.BlockIndex)
 	if err != nil {
 		return false, err
 	}
 
-	isBlockChanged := latestBlock.SHA1Checksum != newBlockChecksum
+	isMoved := getBlockOffset(latestBlock, latestVersion.BlockSize) != candidate.ByteOffset
+	if candidate.IsHole || latestBlock.IsHole {
+		isSameHole := candidate.IsHole && latestBlock.IsHole &&
+			latestBlock.ByteLength == candidate.ByteLength
+		return isMoved || !isSameHole, nil
+	}
+
+	isBlockChanged := latestBlock.Checksum != candidate.Checksum ||
+		latestBlock.ChecksumAlgorithm != ov.ChecksumAlgorithm || isMoved
 	return isBlockChanged, nil
 }
 
-func (e *Engine) isFileContentNew(hash string) (bool, error) {
+// getBlockOffset returns the offset of b within a version with the given
+// block size. Blocks stored before offsets were recorded are always at a
+// multiple of the block size.
+func getBlockOffset(b Block, blockSize int) int64 {
+	if b.ByteLength == 0 {
+		return int64(b.BlockIndex) * int64(blockSize)
+	}
+	return b.ByteOffset
+}
+
+func (e *Engine) isFileContentNew(algorithm, hash string) (bool, error) {
 	var count int
 	err := e.db.Model(&Block{}).Where(&Block{
-		SHA1Checksum: hash,
+		Checksum:          hash,
+		ChecksumAlgorithm: algorithm,
 	}).Count(&count).Error
 	return count > 0, err
 }
 
-func (e *Engine) getPathForBlockWithChecksum(hash string) (string, error) {
+func (e *Engine) getBlockWithChecksum(algorithm, hash string) (Block, error) {
 	var b Block
 	err := e.db.First(&b, &Block{
-		SHA1Checksum: hash,
+		Checksum:          hash,
+		ChecksumAlgorithm: algorithm,
 	}).Error
-	return b.Location, err
+	return b, err
 }
 
 func (e *Engine) openFileWithMode(path string, mode int) (*os.File, error) {
@@ -247,29 +414,131 @@ func (e *Engine) CreateFileForWriting(p string) (*os.File, error) {
 	return e.openFileWithMode(p, os.O_CREATE|os.O_WRONLY)
 }
 
-func (e *Engine) writeBytesAsBlock(ov ObjectVersion, blockNumber int, p []byte) (string, error) {
-	blockName := ov.Name + "-" + strconv.Itoa(ov.Version) + "-" + strconv.Itoa(blockNumber) + ".edis"
-	path := path.Join(e.c.StorageLocation, blockName)
-	if !isFileNew(path) {
-		return path, fmt.Errorf("Block with name %s already exists", path)
+// writeBytesAsBlock encrypts p, whose fingerprint is checksum, and puts it in
+// the block store under a new key. Unless convergent encryption is enabled, the data key
+// with the given ID is used. If packs is not nil, p is added to a pack instead
+// of getting a file of its own. The returned Block only has the fields
+// describing where and how p is stored set.
+func (e *Engine) writeBytesAsBlock(ov ObjectVersion, dataKeyID uint, packs *packWriter, parity *parityWriter,
+	blockNumber int, checksum string, p []byte) (Block, error) {
+	key := ov.Name + "-" + strconv.Itoa(ov.Version) + "-" + strconv.Itoa(blockNumber) + ".edis"
+	if e.c.IsContentAddressed {
+		key = e.getContentAddressedKey(ov.ChecksumAlgorithm, checksum)
+	}
+
+	b := Block{Location: key, Checksum: checksum, ChecksumAlgorithm: ov.ChecksumAlgorithm}
+	if e.c.IsConvergentEncryptionEnabled {
+		b.IsConvergent = true
+	} else {
+		b.DataKeyID = dataKeyID
+	}
+
+	// Another store may have recorded the same content since this one
+	// looked for it, in which case its file is used as it is.
+	if packs == nil && e.c.IsContentAddressed {
+		var existing []Block
+		err := e.db.Where("location = ?", key).Limit(1).Find(&existing).Error
+		if err != nil {
+			return b, err
+		}
+
+		if len(existing) > 0 {
+			isStaged, err := e.stageStoredFile(ov, existing[0])
+			if err != nil || isStaged {
+				return existing[0], err
+			}
+		}
+	}
+
+	codec, err := e.getCompressionCodec()
+	if err != nil {
+		return b, err
+	}
+
+	compressed, codec, err := compress(codec, p)
+	if err != nil {
+		return b, err
+	}
+	b.Codec = codec
+
+	blockKey, err := e.getKeyForBlock(b)
+	if err != nil {
+		return b, err
+	}
+
+	ciphertext, nonce, tag, err := encryptBlock(blockKey, compressed)
+	if err != nil {
+		return b, err
+	}
+	b.Nonce = nonce
+	b.Tag = tag
+	b.StoredLength = len(ciphertext)
+
+	if packs != nil {
+		return b, packs.add(&b, ciphertext)
+	}
+
+	// The key of a deleted version whose number is being reused may still
+	// hold a file that blocks of other objects share.
+	key, err = e.claimKey(ov, key)
+	if err != nil {
+		return b, err
+	}
+	b.Location = key
+
+	err = e.detachParityShards(key)
+	if err != nil {
+		return b, err
+	}
+
+	err = e.store.Put(key, ciphertext)
+	if err != nil || parity == nil {
+		return b, err
+	}
+	return b, parity.add(key, ciphertext)
+}
+
+// readBlock gets the file backing b from the block store, decrypts it, verifying its
+// authentication tag, and decompresses it. The files of blocks stored before
+// encryption was added are returned as they are.
+func (e *Engine) readBlock(b Block) ([]byte, error) {
+	if b.IsHole {
+		return make([]byte, b.ByteLength), nil
 	}
 
-	if e.c.IsDirectIOEnabled && len(p)%directio.BlockSize != 0 {
-		return "", fmt.Errorf("Passed buffer was not a multilpe of the directio block size\n")
+	var ciphertext []byte
+	var err error
+	if b.PackID != 0 {
+		ciphertext, err = e.readPackedBlock(b)
+	} else {
+		ciphertext, err = e.store.Get(b.Location)
+	}
+	if err != nil {
+		return []byte{}, err
+	} else if b.IsPlaintext {
+		return ciphertext, nil
 	}
 
-	f, err := e.CreateFileForWriting(path)
+	key, err := e.getKeyForBlock(b)
 	if err != nil {
-		return path, err
+		return []byte{}, err
 	}
 
-	_, err = f.Write(p)
+	p, err := decryptBlock(key, ciphertext, b.Nonce, b.Tag)
 	if err != nil {
-		return path, err
+		return []byte{}, fmt.Errorf("Could not read block %d of %s version %d from %s: %v",
+			b.BlockIndex, b.ObjectName, b.Version, b.Location, err)
 	}
+	return decompress(b.Codec, p, b.ByteLength)
+}
 
-	err = f.Close()
-	return path, err
+// markPlaintextBlocks marks the blocks of a repository created before blocks
+// were encrypted, which have no nonce, as plaintext. It only runs once, when
+// the marker is added, so that blocks that lose their nonce later on are not
+// taken for plaintext.
+func markPlaintextBlocks(db *gorm.DB) error {
+	return db.Exec("UPDATE blocks SET is_plaintext = ? WHERE is_hole = ? AND (nonce IS NULL OR length(nonce) = 0)",
+		true, false).Error
 }
 
 func (e *Engine) getNextVersionNumber(name string) (int, error) {
@@ -325,24 +594,33 @@ func (e *Engine) RetrieveObject(filePath string, name string, version int) error
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	blocks, err := e.loadBlockInfos(name, version)
 	if err != nil {
 		return err
 	}
 
+	err = truncateRegularFile(file, ov.Size)
+	if err != nil {
+		return err
+	}
+
 	for i := 0; i < len(blocks); i++ {
-		info, err := os.Stat(blocks[i].Location)
-		if err != nil {
-			return err
+		offset := getBlockOffset(blocks[i], ov.BlockSize)
+		if blocks[i].IsHole {
+			err = e.writeHole(file, offset, int64(blocks[i].ByteLength))
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
-		p, err := read(blocks[i].Location, int(info.Size()))
+		p, err := e.readBlock(blocks[i])
 		if err != nil {
 			return err
 		}
 
-		offset := int64(ov.BlockSize * blocks[i].BlockIndex)
 		n, err := file.WriteAt(p, offset)
 		if n != len(p) {
 			return fmt.Errorf("Did not write all bytes from block")
@@ -352,82 +630,229 @@ func (e *Engine) RetrieveObject(filePath string, name string, version int) error
 	return nil
 }
 
-func (e *Engine) makeNewerObjectVersion(file *os.File, name string, blockSize int) (ObjectVersion, error) {
+// truncateRegularFile sets the size of file if it is a regular file, so that
+// any trailing holes are part of it. Files written by objects stored before
+// their size was recorded are left alone.
+func truncateRegularFile(file *os.File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() || size == 0 {
+		return nil
+	}
+	return file.Truncate(size)
+}
+
+// writeHole makes length bytes of file starting at offset read back as zeros,
+// keeping the file sparse where possible.
+func (e *Engine) writeHole(file *os.File, offset, length int64) error {
+	if punchHole(file, offset, length) == nil {
+		return nil
+	}
+
+	var zeros []byte
+	if e.c.IsDirectIOEnabled {
+		zeros = directio.AlignedBlock(int(length))
+	} else {
+		zeros = make([]byte, length)
+	}
+
+	_, err := file.WriteAt(zeros, offset)
+	return err
+}
+
+// RetrieveObjectTo writes a particular object version to w one block after
+// the other, so it can be streamed to a pipe or a device.
+func (e *Engine) RetrieveObjectTo(w io.Writer, name string, version int) error {
+	blocks, err := e.loadBlockInfos(name, version)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		p, err := e.readBlock(blocks[i])
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// makeNewerObjectVersion returns the next version of an object. Its
+// NumberOfBlocks and Size are only known once all its blocks have been read.
+func (e *Engine) makeNewerObjectVersion(name string, blockSize int) (ObjectVersion, error) {
 	nextVersion, err := e.getNextVersionNumber(name)
 	if err != nil {
 		return ObjectVersion{}, err
 	}
 
-	nBlocks, err := e.getNumBlocksInFile(file, blockSize)
+	if e.c.IsContentDefinedChunkingEnabled {
+		blockSize = e.c.MaxChunkSize
+	}
+
+	algorithm, err := e.getChecksumAlgorithm()
 	if err != nil {
 		return ObjectVersion{}, err
 	}
 
 	return ObjectVersion{
-		Name:           name,
-		Version:        nextVersion,
-		NumberOfBlocks: nBlocks,
-		BlockSize:      blockSize,
+		Name:              name,
+		Version:           nextVersion,
+		BlockSize:         blockSize,
+		ChecksumAlgorithm: algorithm,
+		IsContentDefined:  e.c.IsContentDefinedChunkingEnabled,
 	}, nil
 }
 
-func (e *Engine) saveObjectAndBlocksInDatabase(ov ObjectVersion, results []blockWriteResult) error {
-	err := e.db.Create(&ov).Error
-	if err != nil {
-		return err
+// saveObjectAndBlocksInDatabase records ov along with the blocks in results it
+// changed, and ends its store p.
+func (e *Engine) saveObjectAndBlocksInDatabase(p PendingStore, ov ObjectVersion, results []blockWriteResult) error {
+	ov.NumberOfBlocks = len(results)
+	ov.Size = 0
+	for i := 0; i < len(results); i++ {
+		ov.Size += int64(results[i].length)
 	}
 
-	tx := e.db.Begin()
+	var blocks []Block
 	for i := 0; i < len(results); i++ {
 		if results[i].isNew {
-			b := Block{
-				SHA1Checksum: results[i].checksum,
-				Location:     results[i].path,
-				BlockIndex:   results[i].blockNumber,
-				ObjectName:   ov.Name,
-				Version:      ov.Version,
-			}
-			err = tx.Create(&b).Error
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
+			b := results[i].stored
+			b.Checksum = results[i].checksum
+			b.ChecksumAlgorithm = ov.ChecksumAlgorithm
+			b.BlockIndex = results[i].blockNumber
+			b.ByteOffset = results[i].offset
+			b.ByteLength = results[i].length
+			b.ObjectName = ov.Name
+			b.Version = ov.Version
+			blocks = append(blocks, b)
 		}
 	}
+	return e.commitStore(p, ov, blocks)
+}
+
+func (e *Engine) makeChunker(file *os.File, blockSize int) (chunker, error) {
+	if !e.c.IsContentDefinedChunkingEnabled {
+		return makeFixedSizeChunker(e, file, blockSize)
+	}
 
-	return tx.Commit().Error
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return e.makeStreamChunker(file, blockSize)
+}
+
+func (e *Engine) makeStreamChunker(source io.Reader, blockSize int) (chunker, error) {
+	if !e.c.IsContentDefinedChunkingEnabled {
+		return makeStreamChunker(source), nil
+	}
+
+	if e.c.IsDirectIOEnabled {
+		return nil, fmt.Errorf("DirectIO cannot be used with content-defined chunking")
+	}
+	return makeContentDefinedChunker(source, e.c.MinChunkSize, e.c.AverageChunkSize, e.c.MaxChunkSize)
 }
 
-// SaveObject saves a binary object.
+// SaveObject saves a binary object. If content-defined chunking is enabled,
+// blockSize is ignored in favour of the configured chunk sizes.
 func (e *Engine) SaveObject(file *os.File, name string, blockSize int) error {
-	ov, err := e.makeNewerObjectVersion(file, name, blockSize)
+	return e.SaveObjectWithContext(context.Background(), file, name, blockSize)
+}
+
+// SaveObjectWithContext saves a binary object as SaveObject does. If ctx is
+// cancelled before every block is stored, nothing is saved and ctx.Err() is
+// returned.
+func (e *Engine) SaveObjectWithContext(ctx context.Context, file *os.File, name string, blockSize int) error {
+	c, err := e.makeChunker(file, blockSize)
 	if err != nil {
 		return err
 	}
+	return e.saveObjectFromChunker(ctx, c, name, blockSize)
+}
 
-	results, err := makeFileWriterWorkerPool(e, ov, file, e.c.IsDirectIOEnabled).
-		write()
+// SaveObjectFromReader saves a binary object read from r until io.EOF, such
+// as a pipe, without knowing its size in advance.
+func (e *Engine) SaveObjectFromReader(r io.Reader, name string, blockSize int) error {
+	return e.SaveObjectFromReaderWithContext(context.Background(), r, name, blockSize)
+}
+
+// SaveObjectFromReaderWithContext saves a binary object read from r as
+// SaveObjectFromReader does. Cancelling ctx stops it as it does
+// SaveObjectWithContext.
+func (e *Engine) SaveObjectFromReaderWithContext(ctx context.Context, r io.Reader, name string, blockSize int) error {
+	c, err := e.makeStreamChunker(r, blockSize)
+	if err != nil {
+		return err
+	}
+	return e.saveObjectFromChunker(ctx, c, name, blockSize)
+}
+
+func (e *Engine) saveObjectFromChunker(ctx context.Context, c chunker, name string, blockSize int) error {
+	ov, err := e.makeNewerObjectVersion(name, blockSize)
 	if err != nil {
 		return err
 	}
 
-	return e.saveObjectAndBlocksInDatabase(ov, results)
+	_, err = e.getCompressionCodec()
+	if err != nil {
+		return err
+	}
+
+	// The store is begun first so that garbage collection keeps the data key.
+	pending, err := e.beginStore(ov)
+	if err != nil {
+		return err
+	}
+
+	dk, err := e.getDataKeyForObject(name)
+	if err != nil {
+		return e.abandonStoreOnError(pending, err)
+	}
+	return e.abandonStoreOnError(pending, e.writeObjectVersion(ctx, c, pending, ov, dk.ID))
 }
 
-func read(path string, sizeInBytes int) ([]byte, error) {
-	p := make([]byte, sizeInBytes)
-	file, err := os.Open(path)
+// writeObjectVersion writes the blocks c reads as version ov of an object and
+// records it, as part of the store p.
+func (e *Engine) writeObjectVersion(ctx context.Context, c chunker, p PendingStore, ov ObjectVersion, dataKeyID uint) error {
+	packs, err := e.makePackWriter(ov, e.c.PackSize)
+	if err != nil {
+		return err
+	}
+
+	parity, err := e.makeParityWriter(ov, e.c.DataShards, e.c.ParityShards)
 	if err != nil {
-		return p, err
+		return err
 	}
 
-	n, err := file.Read(p)
-	if n != sizeInBytes {
-		return p, fmt.Errorf("Did not read enough data from file")
-	} else if err != nil {
-		return p, err
+	results, err := makeFileWriterWorkerPool(ctx, e, ov, dataKeyID, packs, parity, c, e.c.IsDirectIOEnabled, e.c.NumberOfWriters).
+		write()
+	if err != nil {
+		return err
 	}
-	return p, nil
+
+	if packs != nil {
+		err = packs.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if parity != nil {
+		err = parity.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.saveObjectAndBlocksInDatabase(p, ov, results)
 }
 
 func isFileNew(path string) bool {
@@ -1,12 +1,22 @@
 package edis
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -416,6 +426,1626 @@ func TestFileSizeNotMultipleOfBlockSize(t *testing.T) {
 	}
 }
 
+func TestBlocksAreEncryptedAtRest(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	plaintext, err := read(path, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := e.loadBlockInfos(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := e.store.Get(blocks[0].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(plaintext, stored) {
+		t.Fatalf("Block file contains the plaintext of the block")
+	}
+}
+
+func TestReadingBlocksStoredBeforeEncryption(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	// Turn the blocks back into what they were before encryption.
+	blocks, err := e.loadBlockInfos(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range blocks {
+		if b.IsHole {
+			continue
+		}
+
+		p, err := e.readBlock(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.store.Put(b.Location, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = e.db.Exec("UPDATE blocks SET nonce = NULL, tag = NULL, codec = '' WHERE object_name = ?", objectName).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks that lost their nonce are not taken for plaintext.
+	var retrieved bytes.Buffer
+	err = e.RetrieveObjectTo(&retrieved, objectName, 1)
+	if err == nil {
+		t.Fatal("Retrieving blocks without a nonce succeeded")
+	}
+
+	err = markPlaintextBlocks(e.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved.Reset()
+	err = e.RetrieveObjectTo(&retrieved, objectName, 1)
+	if err != nil || !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatalf("Retrieving unencrypted blocks failed: %v", err)
+	}
+}
+
+func TestRetrievingTamperedBlockFails(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	blocks, err := e.loadBlockInfos(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := e.store.Get(blocks[0].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p[0] ^= 0xff
+	err = e.store.Put(blocks[0].Location, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := path + ".retrieved"
+	defer os.Remove(outputPath)
+	err = e.RetrieveObject(outputPath, objectName, 1)
+	if err == nil {
+		t.Fatalf("Retrieving a tampered block did not fail")
+	}
+}
+
+func TestRotatingMasterKey(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	oldKey := e.c.MasterKey
+	newKey := make([]byte, KeySizeInBytes)
+	_, err = rand.Read(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := e.beginStore(ObjectVersion{Name: objectName, Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.RotateMasterKey(newKey, "")
+	if err == nil {
+		t.Fatal("Rotating the master key while an object is being stored succeeded")
+	}
+
+	err = e.abandonStore(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.RotateMasterKey(newKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.c.MasterKey = newKey
+	e.dataKeys = makeDataKeyCache()
+
+	blocks, err := e.loadBlockInfos(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	correctChecksum, err := getChecksumForPath(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	computedChecksum, err := getChecksumForBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if computedChecksum != correctChecksum {
+		t.Fatal("Checksums were not equal after rotating the master key")
+	}
+
+	other, err := MakeEngine(Configuration{
+		DBPath:          DBPath,
+		StorageLocation: StorageLocation,
+		MasterKey:       oldKey,
+	})
+	other.db.Close()
+	if err == nil {
+		t.Fatal("Opened the repository with the master key that was rotated out")
+	}
+}
+
+func TestConvergentEncryptionDeduplicatesAcrossObjects(t *testing.T) {
+	convergent := e
+	convergent.c.IsConvergentEncryptionEnabled = true
+
+	objectName, path, file, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	err = writeToJunkFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nBlocksStarting, err := getNumberOfUniqueLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = convergent.SaveObject(file, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = convergent.SaveObject(file, objectName+"-foo", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nBlocksNow, err := getNumberOfUniqueLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedNBlocks := DefaultJunkFileSizeInMB * 1024 * 1024 / BlockSizeInBytes
+	if nBlocksNow-nBlocksStarting != expectedNBlocks {
+		t.Fatal("Blocks were not reused")
+	}
+
+	blocks, err := e.loadBlockInfos(objectName+"-foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainChecksum, err := getChecksumForPath(path, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !blocks[0].IsConvergent || blocks[0].Checksum == plainChecksum {
+		t.Fatal("Block was not stored with a keyed fingerprint")
+	}
+
+	correctChecksum, err := getChecksumForPath(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	computedChecksum, err := getChecksumForBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if computedChecksum != correctChecksum {
+		t.Fatal("Checksums were not equal")
+	}
+}
+
+func TestConfigurableChecksumAlgorithms(t *testing.T) {
+	algorithms := []string{ChecksumSHA1, ChecksumSHA256, ChecksumBLAKE2b, ChecksumBLAKE3}
+	for _, algorithm := range algorithms {
+		configured := e
+		configured.c.ChecksumAlgorithm = algorithm
+
+		objectName, path, file, err := createTemporaryFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = writeToJunkFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = configured.SaveObject(file, objectName, BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ov, err := e.getObjectVersion(objectName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ov.ChecksumAlgorithm != algorithm {
+			t.Fatalf("Object version was stored with %s instead of %s", ov.ChecksumAlgorithm, algorithm)
+		}
+
+		blocks, err := e.loadBlockInfos(objectName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range blocks {
+			p, err := e.readBlock(blocks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checksum, err := e.computeChecksum(algorithm, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if blocks[i].ChecksumAlgorithm != algorithm || blocks[i].Checksum != checksum {
+				t.Fatalf("Block %d was not fingerprinted with %s", i, algorithm)
+			}
+		}
+		os.Remove(path)
+	}
+}
+
+func TestContentDefinedChunkingSurvivesInsertion(t *testing.T) {
+	chunked := e
+	chunked.c.IsContentDefinedChunkingEnabled = true
+	chunked.c.MinChunkSize = 16 * 1024
+	chunked.c.AverageChunkSize = 64 * 1024
+	chunked.c.MaxChunkSize = 256 * 1024
+
+	original := make([]byte, DefaultJunkFileSizeInMB*1024*1024)
+	_, err := rand.Read(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectName, path, file, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	_, err = file.Write(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chunked.SaveObject(file, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nLocationsBefore, err := getNumberOfUniqueLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := append([]byte{42}, original...)
+	_, newPath, newFile, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(newPath)
+
+	_, err = newFile.Write(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = chunked.SaveObject(newFile, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nLocationsAfter, err := getNumberOfUniqueLocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nLocationsAfter-nLocationsBefore > 2 {
+		t.Fatalf("Inserting one byte stored %d new blocks", nLocationsAfter-nLocationsBefore)
+	}
+
+	for version, expected := range map[int][]byte{1: original, 2: modified} {
+		outputPath := path + ".retrieved"
+		err = e.RetrieveObject(outputPath, objectName, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		retrieved, err := read(outputPath, len(expected))
+		os.Remove(outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(retrieved, expected) {
+			t.Fatalf("Version %d was not reassembled correctly", version)
+		}
+	}
+}
+
+func TestCompressedBlocksRoundTrip(t *testing.T) {
+	for _, codec := range []string{CodecZstd, CodecLZ4} {
+		compressed := e
+		compressed.c.Compression = codec
+
+		content := make([]byte, DefaultJunkFileSizeInMB*1024*1024)
+		_, err := rand.Read(content[:len(content)/4])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		objectName, path, file, err := createTemporaryFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = file.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = compressed.SaveObject(file, objectName, BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := e.GetCompressionStats(objectName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The second block only holds zeros, so it is a hole.
+		if stats.UncompressedBytes != BlockSizeInBytes || stats.ReusedBytes != 0 || stats.Ratio() <= 1 {
+			t.Fatalf("Blocks were not compressed with %s: %+v", codec, stats)
+		}
+
+		// Blocks whose files were already stored do not count as compressed.
+		err = compressed.SaveObjectFromReader(bytes.NewReader(content), objectName+"-copy", BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err = e.GetCompressionStats(objectName+"-copy", 1)
+		if err != nil || stats.UncompressedBytes != 0 || stats.ReusedBytes != BlockSizeInBytes {
+			t.Fatalf("Storing content again with %s reported %+v and returned %v", codec, stats, err)
+		}
+
+		outputPath := path + ".retrieved"
+		err = e.RetrieveObject(outputPath, objectName, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		retrieved, err := read(outputPath, len(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(retrieved, content) {
+			t.Fatalf("Object compressed with %s was not retrieved correctly", codec)
+		}
+		os.Remove(outputPath)
+		os.Remove(path)
+	}
+}
+
+func TestZeroBlocksAreStoredAsHoles(t *testing.T) {
+	content := make([]byte, 3*BlockSizeInBytes)
+	_, err := rand.Read(content[:BlockSizeInBytes])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = rand.Read(content[2*BlockSizeInBytes:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectName, path, file, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	_, err = file.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.SaveObject(file, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := e.loadBlockInfos(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !blocks[1].IsHole || blocks[1].Location != "" {
+		t.Fatalf("Zero block was not stored as a hole")
+	}
+
+	outputPath := path + ".retrieved"
+	defer os.Remove(outputPath)
+	err = e.RetrieveObject(outputPath, objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved, err := read(outputPath, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved, content) {
+		t.Fatalf("Object with a hole was not retrieved correctly")
+	}
+}
+
+func TestSavingObjectFromReader(t *testing.T) {
+	content := make([]byte, DefaultJunkFileSizeInMB*1024*1024+BlockSizeInBytes/2)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objectName := "reader_" + strconv.Itoa(rand.Int())
+	err = e.SaveObjectFromReader(bytes.NewReader(content), objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ov, err := e.getObjectVersion(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ov.NumberOfBlocks != DefaultJunkFileSizeInMB+1 || ov.Size != int64(len(content)) {
+		t.Fatalf("Object version has %d blocks and %d bytes", ov.NumberOfBlocks, ov.Size)
+	}
+
+	outputPath := path.Join(e.c.StorageLocation, objectName+".retrieved")
+	defer os.Remove(outputPath)
+	err = e.RetrieveObject(outputPath, objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved, err := read(outputPath, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved, content) {
+		t.Fatalf("Object saved from a reader was not retrieved correctly")
+	}
+}
+
+func TestRetrievingObjectToWriter(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retrieved bytes.Buffer
+	err = e.RetrieveObjectTo(&retrieved, objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatalf("Object written to a writer did not match the original")
+	}
+}
+
+func TestRandomAccessToObject(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := e.OpenObject(objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Size() != int64(len(content)) {
+		t.Fatalf("Object reader has size %d instead of %d", r.Size(), len(content))
+	}
+
+	// Straddles the boundary between the first two blocks.
+	p := make([]byte, 4096)
+	off := int64(BlockSizeInBytes - 2048)
+	_, err = r.ReadAt(p, off)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, content[off:off+int64(len(p))]) {
+		t.Fatalf("ReadAt across blocks returned the wrong bytes")
+	}
+
+	_, err = r.Seek(-100, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tail, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tail, content[len(content)-100:]) {
+		t.Fatalf("Reading after seeking to the end returned the wrong bytes")
+	}
+
+	n, err := r.ReadAt(p, r.Size()-10)
+	if n != 10 || err != io.EOF {
+		t.Fatalf("ReadAt past the end returned %d bytes and %v", n, err)
+	}
+}
+
+func TestMountingObjects(t *testing.T) {
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skip("FUSE is not available")
+	}
+
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	mountpoint, err := ioutil.TempDir("", "edis_mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountpoint)
+
+	m, err := e.Mount(mountpoint)
+	if err != nil {
+		t.Skipf("Could not mount: %v", err)
+	}
+	defer func() {
+		m.Unmount()
+		m.Wait()
+	}()
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"1", "latest"} {
+		mounted, err := ioutil.ReadFile(filepath.Join(mountpoint, objectName, version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(mounted, content) {
+			t.Fatalf("Mounted file %s of %s differs from the stored object", version, objectName)
+		}
+	}
+}
+
+func TestServingObjectOverNBD(t *testing.T) {
+	objectName, path, _, err := createAndSaveNewJunkFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	s := &nbdServer{e: &e, isWritable: true}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(server)
+	}()
+
+	var hello struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}
+	err = binary.Read(client, binary.BigEndian, &hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.Write(client, binary.BigEndian, uint32(nbdFlagCNoZeroes))
+
+	exportName := objectName + "/" + nbdLatestExportVersion
+	data := make([]byte, 4+len(exportName)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(exportName)))
+	copy(data[4:], exportName)
+	binary.Write(client, binary.BigEndian, []uint64{nbdOptionMagic, uint64(nbdOptGo)<<32 | uint64(len(data))})
+	client.Write(data)
+
+	for {
+		var reply struct {
+			Magic  uint64
+			Option uint32
+			Type   uint32
+			Length uint32
+		}
+		err = binary.Read(client, binary.BigEndian, &reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info := make([]byte, reply.Length)
+		io.ReadFull(client, info)
+		if reply.Type == nbdRepAck {
+			break
+		} else if reply.Type != nbdRepInfo {
+			t.Fatalf("Export %s was refused: %s", exportName, info)
+		}
+	}
+
+	request := func(command uint16, offset uint64, length uint32) {
+		binary.Write(client, binary.BigEndian, struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}{nbdRequestMagic, 0, command, 1, offset, length})
+	}
+	readReply := func(p []byte) {
+		var reply struct {
+			Magic  uint32
+			Error  uint32
+			Handle uint64
+		}
+		err := binary.Read(client, binary.BigEndian, &reply)
+		if err != nil || reply.Error != 0 {
+			t.Fatalf("Request failed with %v and error %d", err, reply.Error)
+		}
+		io.ReadFull(client, p)
+	}
+
+	patch := []byte("written over nbd")
+	request(nbdCmdWrite, BlockSizeInBytes-5, uint32(len(patch)))
+	client.Write(patch)
+	readReply(nil)
+	copy(content[BlockSizeInBytes-5:], patch)
+
+	p := make([]byte, 64)
+	request(nbdCmdRead, BlockSizeInBytes-32, uint32(len(p)))
+	readReply(p)
+	if !bytes.Equal(p, content[BlockSizeInBytes-32:BlockSizeInBytes+32]) {
+		t.Fatalf("Reading over NBD did not return the written bytes")
+	}
+
+	request(nbdCmdDisc, 0, 0)
+	err = <-served
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved bytes.Buffer
+	err = e.RetrieveObjectTo(&saved, objectName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(saved.Bytes(), content) {
+		t.Fatalf("Writes over NBD were not saved as version 2 of %s", objectName)
+	}
+}
+
+func TestMigratingToContentAddressedLayout(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	flat, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flat.db.Close()
+
+	content := make([]byte, 2*BlockSizeInBytes)
+	rand.Read(content[:BlockSizeInBytes])
+	copy(content[BlockSizeInBytes:], content[:BlockSizeInBytes])
+	err = flat.SaveObjectFromReader(bytes.NewReader(content), "a/b", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := flat.beginStore(ObjectVersion{Name: "d", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = flat.MigrateToContentAddressedLayout()
+	if err == nil {
+		t.Fatal("Migrating while an object is being stored succeeded")
+	}
+
+	err = flat.abandonStore(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := flat.MigrateToContentAddressedLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved != 1 {
+		t.Fatalf("Migrating moved %d files instead of 1", moved)
+	}
+
+	contentAddressed := flat
+	contentAddressed.c.IsContentAddressed = true
+	err = contentAddressed.SaveObjectFromReader(bytes.NewReader(content[:BlockSizeInBytes]), "c", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isLayout := regexp.MustCompile(`^[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{64}\.blk$`)
+	for _, name := range []string{"a/b", "c"} {
+		blocks, err := flat.loadBlockInfos(name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < len(blocks); i++ {
+			if !isLayout.MatchString(blocks[i].Location) {
+				t.Fatalf("Block %d of %s is stored at %s", i, name, blocks[i].Location)
+			}
+		}
+	}
+
+	var retrieved bytes.Buffer
+	err = flat.RetrieveObjectTo(&retrieved, "a/b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatalf("Migrated object differs from the original")
+	}
+
+	// Content another store is writing the key of gets a key of its own.
+	other := make([]byte, BlockSizeInBytes)
+	rand.Read(other)
+	algorithm, err := contentAddressed.getChecksumAlgorithm()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum, err := contentAddressed.computeChecksum(algorithm, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := contentAddressed.getContentAddressedKey(algorithm, checksum)
+	pending, err = contentAddressed.beginStore(ObjectVersion{Name: "e", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = contentAddressed.stageFile(ObjectVersion{Name: "e", Version: 1}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = contentAddressed.SaveObjectFromReader(bytes.NewReader(other), "d", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := contentAddressed.loadBlockInfos("d", 1)
+	if err != nil || blocks[0].Location == key {
+		t.Fatalf("Block was written to the key another store is writing: %v", err)
+	}
+
+	err = contentAddressed.abandonStore(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved.Reset()
+	err = contentAddressed.RetrieveObjectTo(&retrieved, "d", 1)
+	if err != nil || !bytes.Equal(retrieved.Bytes(), other) {
+		t.Fatalf("Retrieving content stored next to a staged key failed: %v", err)
+	}
+}
+
+func TestPackingAndRepacking(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	packed, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+		PackSize:        4 * BlockSizeInBytes,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packed.db.Close()
+
+	contents := make(map[string][]byte)
+	for _, name := range []string{"a", "b"} {
+		contents[name] = make([]byte, 2*BlockSizeInBytes)
+		rand.Read(contents[name])
+		err = packed.SaveObjectFromReader(bytes.NewReader(contents[name]), name, BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := packed.Repack()
+	if err != nil || removed != 0 {
+		t.Fatalf("Repacking full packs removed %d packs and returned %v", removed, err)
+	}
+
+	packed.c.PackSize = 8 * BlockSizeInBytes
+	pending, err := packed.beginStore(ObjectVersion{Name: "c", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = packed.Repack()
+	if err == nil {
+		t.Fatal("Repacking while an object is being stored succeeded")
+	}
+
+	err = packed.abandonStore(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err = packed.Repack()
+	if err != nil || removed != 2 {
+		t.Fatalf("Repacking small packs removed %d packs and returned %v", removed, err)
+	}
+
+	var packs []Pack
+	err = packed.db.Find(&packs).Error
+	if err != nil || len(packs) != 1 {
+		t.Fatalf("Repacking left %d packs and returned %v", len(packs), err)
+	}
+
+	p, err := packed.store.Get(packs[0].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := readPackIndex(p)
+	if err != nil || len(index) != 4 {
+		t.Fatalf("Pack index has %d entries and returned %v", len(index), err)
+	}
+
+	for name, content := range contents {
+		var retrieved bytes.Buffer
+		err = packed.RetrieveObjectTo(&retrieved, name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(retrieved.Bytes(), content) {
+			t.Fatalf("Repacked object %s differs from the original", name)
+		}
+	}
+}
+
+func TestDeletingObjectsAndCollectingGarbage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	collected, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collected.db.Close()
+
+	first := make([]byte, 3*BlockSizeInBytes)
+	rand.Read(first)
+	second := append([]byte{}, first...)
+	rand.Read(second[BlockSizeInBytes : 2*BlockSizeInBytes])
+	for _, content := range [][]byte{first, second} {
+		err = collected.SaveObjectFromReader(bytes.NewReader(content), "a", BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Version 2 only changed the middle block, so it keeps the others of
+	// version 1.
+	err = collected.DeleteObjectVersion("a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := collected.CollectGarbage(true)
+	if err != nil || stats.Files != 1 || stats.Bytes == 0 {
+		t.Fatalf("Dry run found %d files of %d bytes and returned %v", stats.Files, stats.Bytes, err)
+	}
+
+	stats, err = collected.CollectGarbage(false)
+	if err != nil || stats.Files != 1 {
+		t.Fatalf("Collecting garbage removed %d files and returned %v", stats.Files, err)
+	}
+
+	var retrieved bytes.Buffer
+	err = collected.RetrieveObjectTo(&retrieved, "a", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), second) {
+		t.Fatal("Remaining version differs from the original")
+	}
+
+	err = collected.DeleteObject("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = collected.CollectGarbage(false)
+	if err != nil || stats.Files != 3 {
+		t.Fatalf("Collecting garbage removed %d files and returned %v", stats.Files, err)
+	}
+
+	var dataKeys []DataKey
+	err = collected.db.Find(&dataKeys).Error
+	if err != nil || len(dataKeys) != 0 {
+		t.Fatalf("%d data keys were left and returned %v", len(dataKeys), err)
+	}
+
+	// A deleted object whose files another object shares can be stored
+	// again under the same version number.
+	for _, name := range []string{"a", "b"} {
+		err = collected.SaveObjectFromReader(bytes.NewReader(first), name, BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = collected.DeleteObject("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = collected.SaveObjectFromReader(bytes.NewReader(second), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string][]byte{"a": second, "b": first} {
+		retrieved.Reset()
+		err = collected.RetrieveObjectTo(&retrieved, name, 1)
+		if err != nil || !bytes.Equal(retrieved.Bytes(), content) {
+			t.Fatalf("Retrieving %s after storing a again failed: %v", name, err)
+		}
+	}
+
+	// Files of a store that has not completed, and temporary files that may
+	// still be being written, are kept.
+	pending := ObjectVersion{Name: "c", Version: 1}
+	_, err = collected.beginStore(pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := collected.claimKey(pending, "staged.blk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temporaryKey, err := makeTemporaryKey("written.blk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{key, temporaryKey} {
+		err = collected.store.Put(key, first)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err = collected.CollectGarbage(false)
+	if err != nil || stats.Files != 0 {
+		t.Fatalf("Collecting garbage during a store removed %d files and returned %v", stats.Files, err)
+	}
+}
+
+func TestPruningWithRetentionPolicy(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	pruned, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pruned.db.Close()
+
+	createdAt := []time.Time{
+		time.Date(2026, 1, 15, 12, 0, 0, 0, time.Local),
+		time.Date(2026, 3, 8, 12, 0, 0, 0, time.Local),
+		time.Date(2026, 3, 9, 9, 0, 0, 0, time.Local),
+		time.Date(2026, 3, 9, 18, 0, 0, 0, time.Local),
+		time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local),
+	}
+	contents := make([][]byte, len(createdAt))
+	for _, name := range []string{"other", "nightly/db"} {
+		for i := 0; i < len(createdAt); i++ {
+			contents[i] = make([]byte, BlockSizeInBytes)
+			rand.Read(contents[i])
+			err = pruned.SaveObjectFromReader(bytes.NewReader(contents[i]), name, BlockSizeInBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = pruned.db.Exec("UPDATE object_versions SET created_at = ? WHERE name = ? AND version = ?",
+				createdAt[i], name, i+1).Error
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = pruned.SetRetentionPolicy(RetentionPolicy{Pattern: "nightly/*", KeepDaily: 2, KeepMonthly: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := pruned.GetRetentionPolicies()
+	if err != nil || len(policies) != 1 {
+		t.Fatalf("Found %d stored policies and returned %v", len(policies), err)
+	}
+
+	// The last two days keep versions 5 and 4, and the last two months
+	// versions 5 and 1.
+	dropped, err := pruned.Prune(policies, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dropped) != 2 || dropped[0].Version != 2 || dropped[1].Version != 3 || dropped[0].Name != "nightly/db" {
+		t.Fatalf("Pruning deleted %v", dropped)
+	}
+
+	versions, err := pruned.getObjectVersions("other")
+	if err != nil || len(versions) != len(createdAt) {
+		t.Fatalf("Pruning left %d versions of an object without a policy and returned %v", len(versions), err)
+	}
+
+	// An empty pattern applies to every object, whether its name has a "/"
+	// or not.
+	dropped, err = pruned.Prune([]RetentionPolicy{{KeepLast: 1}}, true)
+	if err != nil || len(dropped) != 2+len(createdAt)-1 {
+		t.Fatalf("Pruning every object would delete %v and returned %v", dropped, err)
+	}
+
+	var retrieved bytes.Buffer
+	err = pruned.RetrieveObjectTo(&retrieved, "nightly/db", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), contents[3]) {
+		t.Fatal("Kept version differs from the original")
+	}
+}
+
+func TestVerifyingObjects(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	verified, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer verified.db.Close()
+
+	content := make([]byte, 3*BlockSizeInBytes)
+	rand.Read(content)
+	err = verified.SaveObjectFromReader(bytes.NewReader(content), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := verified.Verify("", 0, 100)
+	if err != nil || !report.IsHealthy() || report.Versions != 1 || report.Files != 3 {
+		t.Fatalf("Verifying an intact repository returned %+v and %v", report, err)
+	}
+
+	blocks, err := verified.loadBlockInfos("a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := verified.store.Get(blocks[0].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p[0] ^= 1
+	err = verified.store.Put(blocks[0].Location, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verified.store.Delete(blocks[1].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verified.store.Put("stray.edis", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = verified.Verify("", 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.IsHealthy() || len(report.Corrupt) != 1 || len(report.Missing) != 1 || len(report.Orphaned) != 1 {
+		t.Fatalf("Verifying a damaged repository returned %+v", report)
+	}
+}
+
+func TestScrubbingRepairsBlocksFromParity(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	protected, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "db"),
+		StorageLocation: directory,
+		MasterKey:       e.c.MasterKey,
+		DataShards:      3,
+		ParityShards:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer protected.db.Close()
+
+	content := make([]byte, 4*BlockSizeInBytes)
+	rand.Read(content)
+	err = protected.SaveObjectFromReader(bytes.NewReader(content), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := protected.CollectGarbage(true)
+	if err != nil || stats.Files != 0 {
+		t.Fatalf("Parity files were found to be garbage: %d files, %v", stats.Files, err)
+	}
+
+	blocks, err := protected.loadBlockInfos("a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := protected.store.Get(blocks[0].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p[len(p)/2] ^= 1
+	err = protected.store.Put(blocks[0].Location, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = protected.store.Delete(blocks[3].Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := protected.Scrub(false)
+	if err != nil || report.Groups != 2 || len(report.Damaged) != 2 || len(report.Repaired) != 0 {
+		t.Fatalf("Scrubbing returned %+v and %v", report, err)
+	}
+
+	report, err = protected.Scrub(true)
+	if err != nil || len(report.Repaired) != 2 || len(report.Unrecoverable) != 0 {
+		t.Fatalf("Scrubbing with repairs returned %+v and %v", report, err)
+	}
+
+	var retrieved bytes.Buffer
+	err = protected.RetrieveObjectTo(&retrieved, "a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatal("Repaired object differs from the original")
+	}
+}
+
+func TestSyncingToAnotherRepository(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	source, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "source.db"),
+		StorageLocation: filepath.Join(directory, "source"),
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.db.Close()
+
+	key := make([]byte, KeySizeInBytes)
+	rand.Read(key)
+	destination, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "destination.db"),
+		StorageLocation: filepath.Join(directory, "destination"),
+		MasterKey:       key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.db.Close()
+
+	versions := [][]byte{make([]byte, 3*BlockSizeInBytes)}
+	rand.Read(versions[0])
+	versions = append(versions, append([]byte{}, versions[0]...))
+	rand.Read(versions[1][BlockSizeInBytes : 2*BlockSizeInBytes])
+	for _, content := range versions {
+		err = source.SaveObjectFromReader(bytes.NewReader(content), "a", BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := source.SyncTo(&destination, "")
+	if err != nil || stats.Versions != 2 || stats.Files != 4 {
+		t.Fatalf("Syncing copied %+v and returned %v", stats, err)
+	}
+
+	// Only the block that changed is copied for a new version.
+	versions = append(versions, append([]byte{}, versions[1]...))
+	rand.Read(versions[2][2*BlockSizeInBytes:])
+	err = source.SaveObjectFromReader(bytes.NewReader(versions[2]), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = source.SyncTo(&destination, "a")
+	if err != nil || stats.Versions != 1 || stats.Files != 1 {
+		t.Fatalf("Syncing again copied %+v and returned %v", stats, err)
+	}
+
+	for i, content := range versions {
+		var retrieved bytes.Buffer
+		err = destination.RetrieveObjectTo(&retrieved, "a", i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(retrieved.Bytes(), content) {
+			t.Fatalf("Synced version %d differs from the original", i+1)
+		}
+	}
+}
+
+func TestExportingAndImportingBundles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	exporter, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "exporter.db"),
+		StorageLocation: filepath.Join(directory, "exporter"),
+		MasterKey:       e.c.MasterKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.db.Close()
+
+	key := make([]byte, KeySizeInBytes)
+	rand.Read(key)
+	importer, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "importer.db"),
+		StorageLocation: filepath.Join(directory, "importer"),
+		MasterKey:       key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer importer.db.Close()
+
+	versions := [][]byte{make([]byte, 3*BlockSizeInBytes)}
+	rand.Read(versions[0])
+	versions = append(versions, append([]byte{}, versions[0]...))
+	rand.Read(versions[1][BlockSizeInBytes : 2*BlockSizeInBytes])
+	for _, content := range versions {
+		err = exporter.SaveObjectFromReader(bytes.NewReader(content), "a", BlockSizeInBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundleKey := make([]byte, KeySizeInBytes)
+	rand.Read(bundleKey)
+	var full, incremental bytes.Buffer
+	err = exporter.ExportObjectVersion(&full, "a", 1, 0, bundleKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = exporter.ExportObjectVersion(&incremental, "a", 2, 1, bundleKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if incremental.Len() >= 2*BlockSizeInBytes {
+		t.Fatalf("Bundle relative to a base version holds %d bytes", incremental.Len())
+	}
+
+	_, _, err = importer.ImportObjectVersion(bytes.NewReader(full.Bytes()), "", 0, key, "")
+	if err == nil {
+		t.Fatal("Importing a bundle with the wrong key succeeded")
+	}
+
+	// Lengths are checked before anything is allocated for a record.
+	huge := append(append([]byte{}, bundleMagic...), 0xff, 0xff, 0xff, 0xff)
+	_, _, err = importer.ImportObjectVersion(bytes.NewReader(huge), "", 0, bundleKey, "")
+	if err == nil {
+		t.Fatal("Importing a bundle with an overlong record succeeded")
+	}
+
+	// Blocks of another bundle with the same key are not taken for those of
+	// the bundle.
+	var other bytes.Buffer
+	err = exporter.ExportObjectVersion(&other, "a", 1, 0, bundleKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getHeaderLength := func(bundle []byte) int {
+		r := bytes.NewReader(bundle[len(bundleMagic):])
+		for i := 0; i < 4; i++ {
+			_, err := readBundleRecord(r, maxBundleManifestSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return len(bundle) - r.Len()
+	}
+
+	spliced := append([]byte{}, full.Bytes()[:getHeaderLength(full.Bytes())]...)
+	spliced = append(spliced, other.Bytes()[getHeaderLength(other.Bytes()):]...)
+	_, _, err = importer.ImportObjectVersion(bytes.NewReader(spliced), "b", 0, bundleKey, "")
+	if err == nil {
+		t.Fatal("Importing a bundle with the blocks of another one succeeded")
+	}
+
+	_, stats, err := importer.ImportObjectVersion(&full, "", 0, bundleKey, "")
+	if err != nil || stats.Files != 3 {
+		t.Fatalf("Importing a bundle wrote %d files and returned %v", stats.Files, err)
+	}
+
+	ov, stats, err := importer.ImportObjectVersion(&incremental, "", 0, bundleKey, "")
+	if err != nil || stats.Files != 1 || ov.Version != 2 {
+		t.Fatalf("Importing an incremental bundle as version %d wrote %d files and returned %v", ov.Version, stats.Files, err)
+	}
+
+	for i, content := range versions {
+		var retrieved bytes.Buffer
+		err = importer.RetrieveObjectTo(&retrieved, "a", i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(retrieved.Bytes(), content) {
+			t.Fatalf("Imported version %d differs from the original", i+1)
+		}
+	}
+}
+
+func TestRecoveringIncompleteStores(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	c := Configuration{
+		DBPath:          filepath.Join(directory, "edis.db"),
+		StorageLocation: filepath.Join(directory, "blocks"),
+		MasterKey:       e.c.MasterKey,
+	}
+	engine, err := MakeEngine(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop a store of a version after one of its blocks is written, as if its
+	// process had died.
+	ov, err := engine.makeNewerObjectVersion("a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dk, err := engine.getDataKeyForObject("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := engine.beginStore(ov)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := make([]byte, BlockSizeInBytes)
+	rand.Read(p)
+	b, err := engine.writeBytesAsBlock(ov, dk.ID, nil, nil, 0, "unrecorded", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exited := exec.Command("true")
+	err = exited.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.db.Model(&pending).Update("pid", exited.Process.Pid).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.db.Close()
+
+	engine, err = MakeEngine(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.db.Close()
+
+	exists, err := engine.store.Exists(b.Location)
+	if err != nil || exists {
+		t.Fatalf("Block file of the incomplete store still exists: %v", err)
+	}
+
+	var count int
+	engine.db.Model(&PendingStore{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("%d pending stores are left after recovery", count)
+	}
+
+	// The version number is free again, and a complete store leaves no
+	// temporary files.
+	err = engine.SaveObjectFromReader(bytes.NewReader(p), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retrieved bytes.Buffer
+	err = engine.RetrieveObjectTo(&retrieved, "a", 1)
+	if err != nil || !bytes.Equal(retrieved.Bytes(), p) {
+		t.Fatalf("Retrieving the stored version failed: %v", err)
+	}
+
+	keys, err := engine.store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if strings.HasSuffix(key, temporarySuffix) {
+			t.Fatalf("Temporary file %s was left behind", key)
+		}
+	}
+}
+
+// startSFTPServer starts an SSH server that only serves SFTP, to any client.
 func fetchAndCheck(objectName string, version int, b []Block) (bool, error) {
 	fetchedVersionOneBlocks, err := e.loadBlockInfos(objectName, 1)
 	if err != nil {
@@ -448,7 +2078,8 @@ func isEqual(a, b []Block) bool {
 		isCorrect := (a[i].BlockIndex == b[i].BlockIndex &&
 			a[i].Location == b[i].Location &&
 			a[i].ObjectName == b[i].ObjectName &&
-			a[i].SHA1Checksum == b[i].SHA1Checksum &&
+			a[i].Checksum == b[i].Checksum &&
+			a[i].ChecksumAlgorithm == b[i].ChecksumAlgorithm &&
 			a[i].Version == b[i].Version)
 		if !isCorrect {
 			return false
@@ -496,18 +2127,13 @@ func getChecksumForBlocks(blocks []Block) (string, error) {
 	}
 	p := make([]byte, fileSize)
 	for i := 0; i < len(blocks); i++ {
-		info, err := os.Stat(blocks[i].Location)
-		if err != nil {
-			return "", err
-		}
-
-		q, err := read(blocks[i].Location, int(info.Size()))
+		q, err := e.readBlock(blocks[i])
 		if err != nil {
 			return "", err
 		}
 
 		baseIndex := blocks[i].BlockIndex * BlockSizeInBytes
-		for j := 0; j < int(info.Size()); j++ {
+		for j := 0; j < len(q); j++ {
 			p[baseIndex+j] = q[j]
 		}
 	}
@@ -518,22 +2144,29 @@ func getChecksumForBlocks(blocks []Block) (string, error) {
 func getSizeOfBlocks(blocks []Block) (int64, error) {
 	size := int64(0)
 	for i := 0; i < len(blocks); i++ {
-		info, err := os.Stat(blocks[i].Location)
+		p, err := e.store.Get(blocks[i].Location)
 		if err != nil {
 			return size, err
 		}
 
-		size += info.Size()
+		size += int64(len(p))
 	}
 	return size, nil
 }
 
 func setup() error {
 	rand.Seed(time.Now().UTC().UnixNano())
+	key := make([]byte, KeySizeInBytes)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+
 	engine, err := MakeEngine(Configuration{
 		DBPath:            DBPath,
 		StorageLocation:   StorageLocation,
 		IsDirectIOEnabled: IsDirectIOEnabled,
+		MasterKey:         key,
 	})
 	e = engine
 	return err
@@ -549,8 +2182,99 @@ func teardown() error {
 	return nil
 }
 
+// read returns the first sizeInBytes bytes of the file at path.
+func read(path string, sizeInBytes int) ([]byte, error) {
+	p := make([]byte, sizeInBytes)
+	file, err := os.Open(path)
+	if err != nil {
+		return p, err
+	}
+	defer file.Close()
+
+	n, err := file.Read(p)
+	if n != sizeInBytes {
+		return p, fmt.Errorf("Did not read enough data from file")
+	} else if err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
 func getChecksumForPath(path string, fileSizeInBytes int) (string, error) {
 	p, err := read(path, fileSizeInBytes)
 	hash, err := openssl.SHA1(p)
 	return fmt.Sprintf("%x", hash), err
 }
+
+func TestStoringStopsOnErrorsAndCancellation(t *testing.T) {
+	directory, err := ioutil.TempDir("", "edis_cancel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	err = os.MkdirAll(filepath.Join(directory, "blocks"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := MakeEngine(Configuration{
+		DBPath:          filepath.Join(directory, "edis.db"),
+		StorageLocation: filepath.Join(directory, "blocks"),
+		MasterKey:       e.c.MasterKey,
+		NumberOfWriters: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.db.Close()
+
+	p := make([]byte, 8*BlockSizeInBytes)
+	rand.Read(p)
+	readErr := fmt.Errorf("Input went away")
+	r, w := io.Pipe()
+	go func() {
+		w.Write(p)
+		w.CloseWithError(readErr)
+	}()
+
+	err = engine.SaveObjectFromReader(r, "a", BlockSizeInBytes)
+	if err != readErr {
+		t.Fatalf("Storing from a failing reader returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = engine.SaveObjectFromReaderWithContext(ctx, bytes.NewReader(p), "a", BlockSizeInBytes)
+	if err != context.Canceled {
+		t.Fatalf("Storing with a cancelled context returned %v", err)
+	}
+
+	// Cancelling stops the store even while reading is blocked.
+	blocked, neverClosed := io.Pipe()
+	defer neverClosed.Close()
+	go neverClosed.Write(p)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err = engine.SaveObjectFromReaderWithContext(ctx, blocked, "a", BlockSizeInBytes)
+	if err != context.Canceled {
+		t.Fatalf("Storing from a blocked reader returned %v", err)
+	}
+
+	// Neither store recorded anything or left files behind.
+	isNew, err := engine.isObjectNew("a")
+	if err != nil || !isNew {
+		t.Fatalf("Object was recorded by a failed store: %v", err)
+	}
+
+	keys, err := engine.store.List("")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("Failed stores left %v behind: %v", keys, err)
+	}
+
+	err = engine.SaveObjectFromReader(bytes.NewReader(p), "a", BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
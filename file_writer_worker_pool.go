@@ -1,57 +1,107 @@
 package edis
 
 import (
-	"fmt"
-	"os"
+	"context"
+	"io"
 	"sync"
 
 	"github.com/ncw/directio"
-
-	"github.com/spacemonkeygo/openssl"
 )
 
 type blockWriteTask struct {
 	blockNumber int
+	offset      int64
 	buffer      []byte
 }
 
 type blockWriteResult struct {
-	path        string
 	isNew       bool
 	blockNumber int
+	offset      int64
+	length      int
 	checksum    string
+	stored      Block // where and how the content of a new block is stored
+}
+
+// pendingContent is content that a writer is storing. Writers that come
+// across the same content wait for it instead of storing it again, which
+// would replace a content-addressed file another block is about to use.
+type pendingContent struct {
+	done   chan struct{}
+	stored Block
+	err    error
 }
 
+// fileWriterWorkerPool reads the blocks of an object version with one
+// goroutine and stores them with others. The first error any of them runs
+// into, or ctx being cancelled, stops all of them, and is what write returns.
 type fileWriterWorkerPool struct {
 	bufferSize        int
+	ctx               context.Context
+	cancel            context.CancelFunc
 	e                 *Engine
 	ov                ObjectVersion
-	file              *os.File
+	dataKeyID         uint
+	packs             *packWriter   // nil unless blocks are packed
+	parity            *parityWriter // nil unless block files are protected by parity files
+	chunker           chunker
 	writer            chan blockWriteTask
 	filler            chan []byte
 	finished          chan blockWriteResult
 	isDirectIOEnabled bool
+	numberOfWriters   int
+	numberOfBuffers   int // one more than the writers, so reading never waits on them
+	pendingLock       sync.Mutex
+	pending           map[string]*pendingContent // keyed by checksum
+	reading           sync.WaitGroup
+	errLock           sync.Mutex
+	err               error // the first error that stopped the pool
 }
 
-func makeFileWriterWorkerPool(e *Engine, ov ObjectVersion,
-	f *os.File, isDirectIOEnabled bool) *fileWriterWorkerPool {
+func makeFileWriterWorkerPool(ctx context.Context, e *Engine, ov ObjectVersion, dataKeyID uint, packs *packWriter, parity *parityWriter,
+	c chunker, isDirectIOEnabled bool, numberOfWriters int) *fileWriterWorkerPool {
+	if numberOfWriters < 1 {
+		numberOfWriters = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	return &fileWriterWorkerPool{
 		bufferSize:        ov.BlockSize,
+		ctx:               ctx,
+		cancel:            cancel,
 		e:                 e,
 		ov:                ov,
-		file:              f,
-		filler:            make(chan []byte),
+		dataKeyID:         dataKeyID,
+		packs:             packs,
+		parity:            parity,
+		chunker:           c,
+		filler:            make(chan []byte, numberOfWriters+1),
 		finished:          make(chan blockWriteResult),
 		writer:            make(chan blockWriteTask),
 		isDirectIOEnabled: isDirectIOEnabled,
+		numberOfWriters:   numberOfWriters,
+		numberOfBuffers:   numberOfWriters + 1,
+		pending:           make(map[string]*pendingContent),
 	}
 }
 
+// write returns a result for every block once all of them are stored, or
+// the error that stopped the pool once the writers have returned. The reader
+// may still be waiting on the chunker then, and returns once it is done.
 func (wp *fileWriterWorkerPool) write() ([]blockWriteResult, error) {
+	defer wp.cancel()
 	if err := wp.start(); err != nil {
 		return []blockWriteResult{}, err
 	}
-	return wp.getResults(), nil
+
+	results := wp.getResults()
+	if err := wp.getError(); err != nil {
+		return []blockWriteResult{}, err
+	}
+
+	// The writers only run out of blocks once the reader is done.
+	wp.reading.Wait()
+	return results, nil
 }
 
 func (wp *fileWriterWorkerPool) start() error {
@@ -63,16 +113,30 @@ func (wp *fileWriterWorkerPool) start() error {
 		return err
 	}
 
-	bufferA := wp.makeBufferForFile()
-	bufferB := wp.makeBufferForFile()
-	wp.filler <- bufferA
-	if wp.ov.NumberOfBlocks > 1 {
-		wp.filler <- bufferB
+	for i := 0; i < wp.numberOfBuffers; i++ {
+		wp.filler <- wp.makeBufferForFile()
 	}
 
 	return nil
 }
 
+// fail records err, unless the pool already stopped because of another
+// error, and stops the pool.
+func (wp *fileWriterWorkerPool) fail(err error) {
+	wp.errLock.Lock()
+	if wp.err == nil {
+		wp.err = err
+	}
+	wp.errLock.Unlock()
+	wp.cancel()
+}
+
+func (wp *fileWriterWorkerPool) getError() error {
+	wp.errLock.Lock()
+	defer wp.errLock.Unlock()
+	return wp.err
+}
+
 func (wp *fileWriterWorkerPool) makeBufferForFile() []byte {
 	if wp.isDirectIOEnabled {
 		return directio.AlignedBlock(wp.bufferSize)
@@ -80,100 +144,176 @@ func (wp *fileWriterWorkerPool) makeBufferForFile() []byte {
 	return make([]byte, wp.bufferSize)
 }
 
+// getResults collects a result for every block until the writer is done.
 func (wp *fileWriterWorkerPool) getResults() []blockWriteResult {
-	wg := sync.WaitGroup{}
-	wg.Add(wp.ov.NumberOfBlocks)
-
 	var wr []blockWriteResult
-	go func() {
-		for len(wr) < wp.ov.NumberOfBlocks {
-			x := <-wp.finished
-			wr = append(wr, x)
-			wg.Done()
-		}
-	}()
-
-	wg.Wait()
+	for x := range wp.finished {
+		wr = append(wr, x)
+	}
 	return wr
 }
 
+// startAsynchronousReader starts a goroutine that hands blocks to the writers
+// in order, until the chunker is done or the pool is stopped.
 func (wp *fileWriterWorkerPool) startAsynchronousReader() error {
-	_, err := wp.file.Seek(0, 0)
-	if err != nil {
-		return err
-	}
-
+	wp.reading.Add(1)
 	go func() {
+		defer wp.reading.Done()
+		defer close(wp.writer)
 		blockNumber := 0
-		for blockNumber < wp.ov.NumberOfBlocks {
-			buffer := <-wp.filler
-			isBlockDefinitelyFull := blockNumber < wp.ov.NumberOfBlocks-1
-			if isBlockDefinitelyFull {
-				_, err = wp.file.Read(buffer)
-			} else {
-				buffer, err = wp.e.getBlockInFile(wp.file, wp.ov.BlockSize, blockNumber)
+		offset := int64(0)
+		for {
+			var buffer []byte
+			select {
+			case buffer = <-wp.filler:
+			case <-wp.ctx.Done():
+				wp.fail(wp.ctx.Err())
+				return
 			}
 
-			if err != nil {
-				panic(err)
+			buffer, err := wp.chunker.next(buffer[:cap(buffer)])
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				wp.fail(err)
+				return
 			}
 
-			wp.writer <- blockWriteTask{blockNumber, buffer}
+			select {
+			case wp.writer <- blockWriteTask{blockNumber, offset, buffer}:
+			case <-wp.ctx.Done():
+				wp.fail(wp.ctx.Err())
+				return
+			}
 			blockNumber++
+			offset += int64(len(buffer))
 		}
 	}()
 
 	return nil
 }
 
+// startAsynchronousWriter starts numberOfWriters goroutines that store blocks
+// in parallel, which helps when the block store is remote.
 func (wp *fileWriterWorkerPool) startAsynchronousWriter() error {
+	var running sync.WaitGroup
+	running.Add(wp.numberOfWriters)
 	go func() {
-		for true {
-			task := <-wp.writer
-			hash, err := openssl.SHA1(task.buffer)
-			if err != nil {
-				panic(err)
-			}
+		running.Wait()
+		close(wp.finished)
+	}()
 
-			blockChecksum := fmt.Sprintf("%x", hash)
-			isBlockNew, err := wp.e.isBlockNew(wp.ov, task.blockNumber, blockChecksum)
-			if err != nil {
-				panic(err)
-			}
+	for i := 0; i < wp.numberOfWriters; i++ {
+		go wp.runWriter(&running)
+	}
+	return nil
+}
 
-			if isBlockNew {
-				var pathToBlock string
-				isFileContentNew, err := wp.e.isFileContentNew(blockChecksum)
-				if !isFileContentNew {
-					pathToBlock, err = wp.e.writeBytesAsBlock(wp.ov, task.blockNumber, task.buffer)
-					if err != nil {
-						panic(err)
-					}
-				} else {
-					pathToBlock, err = wp.e.getPathForBlockWithChecksum(blockChecksum)
-					if err != nil {
-						panic(err)
-					}
-				}
-
-				go func() {
-					wp.finished <- blockWriteResult{pathToBlock, true, task.blockNumber, blockChecksum}
-				}()
-			} else {
-				go func() {
-					wp.finished <- blockWriteResult{"", false, task.blockNumber, blockChecksum}
-				}()
+// runWriter stores the blocks it is handed until there are no more, or until
+// the pool is stopped, failing it if one cannot be stored.
+func (wp *fileWriterWorkerPool) runWriter(running *sync.WaitGroup) {
+	defer running.Done()
+	for {
+		var task blockWriteTask
+		var isOpen bool
+		select {
+		case task, isOpen = <-wp.writer:
+			if !isOpen {
+				return
 			}
+		case <-wp.ctx.Done():
+			wp.fail(wp.ctx.Err())
+			return
+		}
 
-			if task.blockNumber == wp.ov.NumberOfBlocks-1 {
-				break
-			} else {
-				go func() {
-					wp.filler <- task.buffer
-				}()
-			}
+		result, err := wp.writeBlock(task)
+		if err != nil {
+			wp.fail(err)
+			return
 		}
-	}()
 
-	return nil
+		wp.finished <- result
+		wp.filler <- task.buffer
+	}
+}
+
+// writeBlock stores the block of task, unless the previous version already
+// has it, and returns what is to be recorded about it.
+func (wp *fileWriterWorkerPool) writeBlock(task blockWriteTask) (blockWriteResult, error) {
+	if isAllZeros(task.buffer) {
+		return wp.writeHole(task)
+	}
+
+	blockChecksum, err := wp.e.computeChecksum(wp.ov.ChecksumAlgorithm, task.buffer)
+	if err != nil {
+		return blockWriteResult{}, err
+	}
+
+	isBlockNew, err := wp.e.isBlockNew(wp.ov, Block{
+		BlockIndex: task.blockNumber,
+		ByteOffset: task.offset,
+		ByteLength: len(task.buffer),
+		Checksum:   blockChecksum,
+	})
+	if err != nil {
+		return blockWriteResult{}, err
+	} else if !isBlockNew {
+		return blockWriteResult{false, task.blockNumber, task.offset, len(task.buffer), blockChecksum, Block{}}, nil
+	}
+
+	stored, err := wp.storeContent(task, blockChecksum)
+	if err != nil {
+		return blockWriteResult{}, err
+	}
+	return blockWriteResult{true, task.blockNumber, task.offset, len(task.buffer), blockChecksum, stored}, nil
+}
+
+// storeContent returns how the content of task is stored, storing it unless
+// it already is or another writer is doing so.
+func (wp *fileWriterWorkerPool) storeContent(task blockWriteTask, checksum string) (Block, error) {
+	wp.pendingLock.Lock()
+	if pending, found := wp.pending[checksum]; found {
+		wp.pendingLock.Unlock()
+		<-pending.done
+		return pending.stored, pending.err
+	}
+
+	pending := &pendingContent{done: make(chan struct{})}
+	wp.pending[checksum] = pending
+	wp.pendingLock.Unlock()
+	defer close(pending.done)
+
+	stored, isStored, err := wp.e.findStoredContent(wp.ov, wp.ov.ChecksumAlgorithm, checksum)
+	if err != nil || isStored {
+		pending.stored, pending.err = stored, err
+	} else {
+		pending.stored, pending.err = wp.e.writeBytesAsBlock(wp.ov, wp.dataKeyID, wp.packs, wp.parity, task.blockNumber, checksum, task.buffer)
+	}
+	return pending.stored, pending.err
+}
+
+// writeHole records a block that only contains zeros without storing any
+// data for it.
+func (wp *fileWriterWorkerPool) writeHole(task blockWriteTask) (blockWriteResult, error) {
+	hole := Block{
+		BlockIndex: task.blockNumber,
+		ByteOffset: task.offset,
+		ByteLength: len(task.buffer),
+		IsHole:     true,
+	}
+
+	isBlockNew, err := wp.e.isBlockNew(wp.ov, hole)
+	if err != nil {
+		return blockWriteResult{}, err
+	}
+	return blockWriteResult{isBlockNew, task.blockNumber, task.offset, len(task.buffer), "", hole}, nil
+}
+
+func isAllZeros(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
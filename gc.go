@@ -0,0 +1,339 @@
+package edis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// blockFileSuffixes are the suffixes of the keys edis writes to a BlockStore,
+// including those of files that are still being written. Anything else found
+// in a store is left alone by CollectGarbage.
+var blockFileSuffixes = []string{".edis", ".blk", ".pack", temporarySuffix}
+
+// GarbageCollectionStats describes the block files that are no longer used.
+type GarbageCollectionStats struct {
+	Files int
+	Bytes int64
+}
+
+// DeleteObjectVersion deletes a version of an object. Blocks the next version
+// inherits from it, because that version did not change them, are handed over
+// to the next version; the rest are forgotten. Their files are only removed
+// by CollectGarbage.
+func (e *Engine) DeleteObjectVersion(name string, version int) error {
+	_, err := e.getObjectVersion(name, version)
+	if err != nil {
+		return fmt.Errorf("Could not find version %d of object %s: %v", version, name, err)
+	}
+
+	versions, err := e.getObjectVersions(name)
+	if err != nil {
+		return err
+	}
+
+	var next *ObjectVersion
+	for i := 0; i < len(versions); i++ {
+		if versions[i].Version > version {
+			next = &versions[i]
+			break
+		}
+	}
+
+	var blocks []Block
+	err = e.db.Where("object_name = ? AND version = ?", name, version).Find(&blocks).Error
+	if err != nil {
+		return err
+	}
+
+	// Versions only have rows for the blocks they changed, so the next
+	// version uses a block of this one if it has no row of its own for it.
+	isChangedInNext := make(map[int]bool)
+	if next != nil {
+		var changed []Block
+		err = e.db.Where("object_name = ? AND version = ?", name, next.Version).Find(&changed).Error
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(changed); i++ {
+			isChangedInNext[changed[i].BlockIndex] = true
+		}
+	}
+
+	tx := e.db.Begin()
+	for i := 0; i < len(blocks); i++ {
+		index := blocks[i].BlockIndex
+		isInherited := next != nil && index < next.NumberOfBlocks && !isChangedInNext[index]
+		if isInherited {
+			err = tx.Exec("UPDATE blocks SET version = ? WHERE object_name = ? AND version = ? AND block_index = ?",
+				next.Version, name, version, index).Error
+		} else {
+			err = tx.Exec("DELETE FROM blocks WHERE object_name = ? AND version = ? AND block_index = ?",
+				name, version, index).Error
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = tx.Exec("DELETE FROM object_versions WHERE name = ? AND version = ?", name, version).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// DeleteObject deletes every version of an object. The files of its blocks
+// are only removed by CollectGarbage.
+func (e *Engine) DeleteObject(name string) error {
+	isNew, err := e.isObjectNew(name)
+	if err != nil {
+		return err
+	} else if isNew {
+		return fmt.Errorf("Could not find any objects with name %s", name)
+	}
+
+	tx := e.db.Begin()
+	err = tx.Exec("DELETE FROM blocks WHERE object_name = ?", name).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Exec("DELETE FROM object_versions WHERE name = ?", name).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// CollectGarbage removes the block files and packs that no block of any
+// remaining version uses, parity files that protect none of those that are
+// left, and the data keys of deleted objects that no block
+// needs anymore. Blocks of other objects may use the files and keys of a
+// deleted object if they had the same content. If isDryRun is set, nothing is
+// removed and the returned statistics describe what would be.
+//
+// Garbage can be collected while objects are being stored: files staged by
+// stores that have not completed are kept, and every file is claimed before
+// it is removed, so that no store can start using it in the meantime. Files
+// abandoned stores left behind are removed by MakeEngine instead. Garbage is
+// not collected while packs are being repacked.
+func (e *Engine) CollectGarbage(isDryRun bool) (GarbageCollectionStats, error) {
+	stats := GarbageCollectionStats{}
+
+	// The store is listed before the database is read, so that every file
+	// listed is either recorded or staged by the time it is.
+	keys, err := e.store.List("")
+	if err != nil {
+		return stats, err
+	}
+
+	usage, err := e.getUsage()
+	if err != nil {
+		return stats, err
+	}
+
+	garbage, err := e.findUnusedBlockFiles(keys, usage.isUsed)
+	if err != nil {
+		return stats, err
+	}
+
+	if isDryRun {
+		for _, key := range garbage {
+			size, err := e.store.Size(key)
+			if err != nil {
+				return stats, err
+			}
+
+			stats.Files++
+			stats.Bytes += size
+		}
+		return stats, nil
+	}
+
+	collection, err := e.beginMaintenance()
+	if err != nil {
+		return stats, fmt.Errorf("Could not start collecting garbage while it is already being collected or packs are being repacked: %v", err)
+	}
+
+	err = e.removeGarbage(garbage, usage, &stats)
+	if err != nil {
+		return stats, e.abandonStoreOnError(collection, err)
+	}
+	return stats, deletePendingStore(e.db, collection)
+}
+
+// removeGarbage removes the files in garbage that can still be claimed, and
+// then what usage says is no longer used.
+func (e *Engine) removeGarbage(garbage []string, usage repositoryUsage, stats *GarbageCollectionStats) error {
+	isRemoved := make(map[string]bool)
+	for _, key := range garbage {
+		isClaimed, err := e.claimLocation(ObjectVersion{}, key)
+		if err != nil {
+			return err
+		} else if !isClaimed {
+			continue
+		}
+
+		size, err := e.store.Size(key)
+		if err != nil {
+			return err
+		}
+
+		err = e.store.Delete(key)
+		if err != nil {
+			return err
+		}
+
+		stats.Files++
+		stats.Bytes += size
+		isRemoved[key] = true
+	}
+
+	// Packs that were never stored are still being written, and packs whose
+	// file was not removed may have been claimed by a store since.
+	for i := 0; i < len(usage.packs); i++ {
+		if usage.packs[i].Size > 0 && isRemoved[usage.packs[i].Location] {
+			err := e.db.Delete(&usage.packs[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := e.deleteUnusedParityGroups(usage.groups, usage.shards, usage.isUsed)
+	if err != nil {
+		return err
+	}
+	return e.deleteUnusedDataKeys(usage.isKeyUsed)
+}
+
+// repositoryUsage is what the recorded blocks, and the stores that have not
+// completed, used at one point in time.
+type repositoryUsage struct {
+	isUsed    map[string]bool // locations of files and packs, and of the parity files protecting them
+	isKeyUsed map[uint]bool   // IDs of data keys
+	packs     []Pack
+	groups    []ParityGroup
+	shards    map[uint][]ParityShard
+}
+
+// getUsage reads what the repository uses in one transaction, so that a
+// store completing in the meantime is either seen as staged or as recorded.
+func (e *Engine) getUsage() (repositoryUsage, error) {
+	usage := repositoryUsage{isUsed: make(map[string]bool), isKeyUsed: make(map[uint]bool)}
+	tx := e.db.Begin()
+	defer tx.Rollback()
+
+	var blocks []Block
+	err := tx.Where("is_hole = ?", false).Find(&blocks).Error
+	if err != nil {
+		return usage, err
+	}
+
+	var staged []StagedFile
+	err = tx.Find(&staged).Error
+	if err != nil {
+		return usage, err
+	}
+
+	err = tx.Find(&usage.packs).Error
+	if err != nil {
+		return usage, err
+	}
+
+	usage.groups, usage.shards, err = getParityGroups(tx)
+	if err != nil {
+		return usage, err
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		usage.isUsed[blocks[i].Location] = true
+		usage.isKeyUsed[blocks[i].DataKeyID] = true
+	}
+
+	for i := 0; i < len(staged); i++ {
+		usage.isUsed[staged[i].Location] = true
+		usage.isKeyUsed[staged[i].DataKeyID] = true
+	}
+
+	addUsedParityLocations(usage.groups, usage.shards, usage.isUsed)
+	return usage, nil
+}
+
+// temporaryFileMaxAge is how long a file can take to be written before its
+// temporary file is considered left behind.
+const temporaryFileMaxAge = 24 * time.Hour
+
+// findUnusedBlockFiles returns the keys of the block files and packs among
+// keys that are not in isUsed. Temporary files are only returned once they are
+// old enough that they are not being written anymore.
+func (e *Engine) findUnusedBlockFiles(keys []string, isUsed map[string]bool) ([]string, error) {
+	var unused []string
+	for _, key := range keys {
+		if isUsed[key] || !isBlockFile(key) {
+			continue
+		}
+
+		if strings.HasSuffix(key, temporarySuffix) {
+			modTime, err := e.store.ModTime(key)
+			if err != nil {
+				return []string{}, err
+			} else if time.Since(modTime) < temporaryFileMaxAge {
+				continue
+			}
+		}
+		unused = append(unused, key)
+	}
+	return unused, nil
+}
+
+// deleteUnusedDataKeys deletes the data keys of objects that have no versions
+// left or being stored and whose ID is not in isKeyUsed. Whether a key is
+// still unused is checked again as it is deleted, since stores may have
+// started using it since isKeyUsed was read.
+func (e *Engine) deleteUnusedDataKeys(isKeyUsed map[uint]bool) error {
+	var dataKeys []DataKey
+	err := e.db.Find(&dataKeys).Error
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(dataKeys); i++ {
+		if isKeyUsed[dataKeys[i].ID] {
+			continue
+		}
+
+		deletion := e.db.Exec("DELETE FROM data_keys WHERE id = ? "+
+			"AND NOT EXISTS (SELECT 1 FROM blocks WHERE data_key_id = ?) "+
+			"AND NOT EXISTS (SELECT 1 FROM staged_files WHERE data_key_id = ?) "+
+			"AND NOT EXISTS (SELECT 1 FROM object_versions WHERE name = ?) "+
+			"AND NOT EXISTS (SELECT 1 FROM pending_stores WHERE object_name = ?)",
+			dataKeys[i].ID, dataKeys[i].ID, dataKeys[i].ID, dataKeys[i].ObjectName, dataKeys[i].ObjectName)
+		if deletion.Error != nil {
+			return deletion.Error
+		} else if deletion.RowsAffected == 0 {
+			continue
+		}
+
+		e.dataKeys.Lock()
+		delete(e.dataKeys.keys, dataKeys[i].ID)
+		e.dataKeys.Unlock()
+	}
+	return nil
+}
+
+func isBlockFile(key string) bool {
+	for _, suffix := range blockFileSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
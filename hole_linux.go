@@ -0,0 +1,16 @@
+//go:build linux
+// +build linux
+
+package edis
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// punchHole deallocates length bytes of f starting at offset, so that they
+// read back as zeros without taking up any space.
+func punchHole(f *os.File, offset, length int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package edis
+
+import (
+	"fmt"
+	"os"
+)
+
+// punchHole is only supported on Linux; elsewhere holes are written out as
+// zeros.
+func punchHole(f *os.File, offset, length int64) error {
+	return fmt.Errorf("Punching holes is not supported on this platform")
+}
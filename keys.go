@@ -0,0 +1,239 @@
+package edis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const saltSizeInBytes = 16
+const scryptN = 1 << 15
+const scryptR = 8
+const scryptP = 1
+
+var masterKeyCheckValue = []byte("edis master key check")
+
+type dataKeyCache struct {
+	sync.Mutex
+	keys map[uint][]byte
+}
+
+func makeDataKeyCache() *dataKeyCache {
+	return &dataKeyCache{keys: make(map[uint][]byte)}
+}
+
+func validateKeySource(key []byte, passphrase string) error {
+	if passphrase == "" && len(key) != KeySizeInBytes {
+		return fmt.Errorf("Master key must be %d bytes, got %d", KeySizeInBytes, len(key))
+	}
+
+	if passphrase != "" && len(key) != 0 {
+		return fmt.Errorf("Only one of a master key and a passphrase may be given")
+	}
+	return nil
+}
+
+// makeMasterKeyInfo derives a master key from key or passphrase and returns
+// it along with the information needed to derive and verify it again.
+func makeMasterKeyInfo(key []byte, passphrase string) (MasterKeyInfo, []byte, error) {
+	info := MasterKeyInfo{ID: 1}
+	if passphrase != "" {
+		info.Salt = make([]byte, saltSizeInBytes)
+		_, err := rand.Read(info.Salt)
+		if err != nil {
+			return info, []byte{}, err
+		}
+		info.ScryptN = scryptN
+		info.ScryptR = scryptR
+		info.ScryptP = scryptP
+	}
+
+	master, err := deriveMasterKey(info, key, passphrase)
+	if err != nil {
+		return info, master, err
+	}
+
+	info.Check, info.CheckNonce, info.CheckTag, err = encryptBlock(master, masterKeyCheckValue)
+	return info, master, err
+}
+
+func deriveMasterKey(info MasterKeyInfo, key []byte, passphrase string) ([]byte, error) {
+	isPassphraseRepository := len(info.Salt) != 0
+	if isPassphraseRepository && passphrase == "" {
+		return []byte{}, fmt.Errorf("The master key of this repository is derived from a passphrase")
+	} else if !isPassphraseRepository && passphrase != "" {
+		return []byte{}, fmt.Errorf("The master key of this repository is read from a keyfile")
+	}
+
+	if !isPassphraseRepository {
+		return key, nil
+	}
+	return scrypt.Key([]byte(passphrase), info.Salt, info.ScryptN, info.ScryptR, info.ScryptP, KeySizeInBytes)
+}
+
+func verifyMasterKey(info MasterKeyInfo, master []byte) error {
+	p, err := decryptBlock(master, info.Check, info.CheckNonce, info.CheckTag)
+	if err != nil || !bytes.Equal(p, masterKeyCheckValue) {
+		return fmt.Errorf("Master key does not match the one used for this repository")
+	}
+	return nil
+}
+
+// loadMasterKey derives the master key and checks it against the repository.
+// The first time a repository is opened, the key is recorded instead.
+func (e *Engine) loadMasterKey(key []byte, passphrase string) ([]byte, error) {
+	if err := validateKeySource(key, passphrase); err != nil {
+		return []byte{}, err
+	}
+
+	var found []MasterKeyInfo
+	err := e.db.Find(&found).Error
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if len(found) == 0 {
+		info, master, err := makeMasterKeyInfo(key, passphrase)
+		if err != nil {
+			return []byte{}, err
+		}
+		return master, e.db.Create(&info).Error
+	}
+
+	master, err := deriveMasterKey(found[0], key, passphrase)
+	if err != nil {
+		return []byte{}, err
+	}
+	return master, verifyMasterKey(found[0], master)
+}
+
+func (e *Engine) getDataKeyForObject(name string) (DataKey, error) {
+	var found []DataKey
+	err := e.db.Find(&found, &DataKey{
+		ObjectName: name,
+	}).Error
+	if err != nil {
+		return DataKey{}, err
+	}
+
+	if len(found) > 0 {
+		return found[0], nil
+	}
+
+	key := make([]byte, KeySizeInBytes)
+	_, err = rand.Read(key)
+	if err != nil {
+		return DataKey{}, err
+	}
+
+	dk := DataKey{ObjectName: name}
+	dk.WrappedKey, dk.Nonce, dk.Tag, err = encryptBlock(e.master, key)
+	if err != nil {
+		return dk, err
+	}
+
+	return dk, e.db.Create(&dk).Error
+}
+
+// loadDataKey returns the unwrapped data key with the given ID.
+func (e *Engine) loadDataKey(id uint) ([]byte, error) {
+	e.dataKeys.Lock()
+	defer e.dataKeys.Unlock()
+	if key, found := e.dataKeys.keys[id]; found {
+		return key, nil
+	}
+
+	var dk DataKey
+	err := e.db.First(&dk, &DataKey{ID: id}).Error
+	if err != nil {
+		return []byte{}, fmt.Errorf("Could not find data key %d: %v", id, err)
+	}
+
+	key, err := decryptBlock(e.master, dk.WrappedKey, dk.Nonce, dk.Tag)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Could not unwrap data key for %s: %v", dk.ObjectName, err)
+	}
+
+	e.dataKeys.keys[id] = key
+	return key, nil
+}
+
+// RotateMasterKey re-wraps every data key and the convergence secret under a
+// new master key, taken from either key or passphrase. Block files are not
+// rewritten. It refuses to run while objects are being stored.
+func (e *Engine) RotateMasterKey(key []byte, passphrase string) error {
+	if err := validateKeySource(key, passphrase); err != nil {
+		return err
+	}
+
+	info, master, err := makeMasterKeyInfo(key, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// Data keys are read in the transaction that re-wraps them, so that none
+	// created in the meantime keeps the old wrapping. Stores create them, so
+	// the key is not rotated while any is running.
+	tx := e.db.Begin()
+	var count int
+	err = tx.Model(&PendingStore{}).Count(&count).Error
+	if err == nil && count > 0 {
+		err = fmt.Errorf("Could not rotate the master key while %d objects are being stored", count)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var all []DataKey
+	err = tx.Find(&all).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i := 0; i < len(all); i++ {
+		dk := all[i]
+		p, err := decryptBlock(e.master, dk.WrappedKey, dk.Nonce, dk.Tag)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Could not unwrap data key for %s: %v", dk.ObjectName, err)
+		}
+
+		dk.WrappedKey, dk.Nonce, dk.Tag, err = encryptBlock(master, p)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Save(&dk).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = wrapConvergenceSecret(&info, master, e.convergenceSecret)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Save(&info).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	e.master = master
+	return nil
+}
@@ -0,0 +1,141 @@
+package edis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+var blockNameLabel = []byte("edis block name")
+
+// getContentAddressedKey returns the key of the block with the given
+// fingerprint in the content-addressed layout. The fingerprint is hashed with
+// the convergence secret first, so that the block store does not learn the
+// hashes of plaintext blocks, and the key is fanned out over two levels of
+// directories so that none of them gets too large.
+func (e *Engine) getContentAddressedKey(algorithm, checksum string) string {
+	mac := hmac.New(sha256.New, e.convergenceSecret)
+	mac.Write(blockNameLabel)
+	mac.Write([]byte(algorithm + ":" + checksum))
+	name := hex.EncodeToString(mac.Sum(nil))
+	return name[0:2] + "/" + name[2:4] + "/" + name + ".blk"
+}
+
+// MigrateToContentAddressedLayout moves every block stored in a file of its
+// own to its content-addressed key and points the blocks that use it there. Blocks with
+// the same content that were stored more than once end up sharing one file.
+// It returns how many files were moved.
+//
+// Migrating moves files recorded blocks use, so like Repack it refuses to
+// start while objects are being stored or other maintenance is running, and
+// neither must start before it is done.
+func (e *Engine) MigrateToContentAddressedLayout() (int, error) {
+	migration, err := e.beginMaintenance()
+	if err != nil {
+		return 0, fmt.Errorf("Could not start migrating while packs are being repacked or garbage is being collected: %v", err)
+	}
+
+	var count int
+	err = e.db.Model(&PendingStore{}).Where("id != ?", migration.ID).Count(&count).Error
+	if err == nil && count > 0 {
+		err = fmt.Errorf("Could not start migrating while %d objects are being stored", count)
+	}
+
+	if err != nil {
+		return 0, e.abandonStoreOnError(migration, err)
+	}
+
+	moved, err := e.migrateToContentAddressedLayout()
+	if err != nil {
+		return moved, e.abandonStoreOnError(migration, err)
+	}
+	return moved, deletePendingStore(e.db, migration)
+}
+
+func (e *Engine) migrateToContentAddressedLayout() (int, error) {
+	var all []Block
+	err := e.db.Where("is_hole = ?", false).Find(&all).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// One block per file is enough to know what it contains.
+	var locations []string
+	byLocation := make(map[string]Block)
+	for i := 0; i < len(all); i++ {
+		isPacked := all[i].PackID != 0
+		if _, found := byLocation[all[i].Location]; !found && !isPacked && all[i].Location != "" {
+			byLocation[all[i].Location] = all[i]
+			locations = append(locations, all[i].Location)
+		}
+	}
+
+	moved := 0
+	for _, location := range locations {
+		b := byLocation[location]
+		key := e.getContentAddressedKey(b.ChecksumAlgorithm, b.Checksum)
+		if key == location {
+			continue
+		}
+
+		var existing []Block
+		err = e.db.Where("location = ?", key).Limit(1).Find(&existing).Error
+		if err != nil {
+			return moved, err
+		}
+
+		// If the content was already moved from another file, reuse that
+		// file along with how it was encrypted. It was encrypted apart from
+		// the old file, so parity groups no longer protect the old one.
+		if len(existing) > 0 {
+			b = existing[0]
+			err = e.detachParityShards(location)
+			if err != nil {
+				return moved, err
+			}
+		} else {
+			p, err := e.store.Get(location)
+			if err != nil {
+				return moved, err
+			}
+
+			// The new file is staged for the migration, so that it is
+			// removed if the migration stops before blocks use it.
+			err = e.stageFile(ObjectVersion{}, key)
+			if err == nil {
+				err = e.store.Put(key, p)
+			}
+
+			if err != nil {
+				return moved, err
+			}
+
+			err = e.db.Exec("UPDATE parity_shards SET location = ? WHERE location = ?", key, location).Error
+			if err != nil {
+				return moved, err
+			}
+		}
+
+		err = e.db.Exec("UPDATE blocks SET location = ?, nonce = ?, tag = ?, is_plaintext = ?, data_key_id = ?, "+
+			"is_convergent = ?, codec = ?, stored_length = ? WHERE location = ?",
+			key, b.Nonce, b.Tag, b.IsPlaintext, b.DataKeyID, b.IsConvergent, b.Codec, b.StoredLength, location).Error
+		if err != nil {
+			return moved, err
+		}
+
+		// The old file is claimed before it is removed, so that nothing
+		// starts using it in the meantime.
+		isClaimed, err := e.claimLocation(ObjectVersion{}, location)
+		if err != nil {
+			return moved, err
+		} else if isClaimed {
+			err = e.store.Delete(location)
+			if err != nil {
+				return moved, err
+			}
+		}
+		moved++
+	}
+	return moved, nil
+}
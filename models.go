@@ -1,18 +1,127 @@
 package edis
 
+import "time"
+
 // Block is the Gorm model that represents a single block of the file.
 type Block struct {
-	SHA1Checksum string
-	Location     string
-	BlockIndex   int    `gorm:"unique_index:block_index_version_object_name"` // 0-based
-	Version      int    `gorm:"unique_index:block_index_version_object_name"`
-	ObjectName   string `gorm:"unique_index:block_index_version_object_name"`
+	Checksum          string
+	ChecksumAlgorithm string
+	Location          string
+	Nonce             []byte // AES-GCM nonce used to encrypt the file at Location
+	Tag               []byte // AES-GCM authentication tag for the file at Location
+	IsPlaintext       bool   // if set, the file was stored before blocks were encrypted
+	DataKeyID         uint   // DataKey used to encrypt the file at Location
+	IsConvergent      bool   // if set, the key is derived from Checksum instead
+	ByteOffset        int64  // offset of the block within its object version
+	ByteLength        int    // uncompressed; 0 for blocks stored before offsets were recorded
+	Codec             string // compression applied before encryption
+	StoredLength      int    // size of the file at Location
+	IsHole            bool   // if set, the block only contains zeros and has no Location
+	PackID            uint   // Pack the file is in, or 0 if it is the whole file at Location
+	PackOffset        int64  // offset of the file within its pack
+	BlockIndex        int    `gorm:"unique_index:block_index_version_object_name"` // 0-based
+	Version           int    `gorm:"unique_index:block_index_version_object_name"`
+	ObjectName        string `gorm:"unique_index:block_index_version_object_name"`
 }
 
 // ObjectVersion represents a version of a binary object.
 type ObjectVersion struct {
-	Name           string `gorm:"unique_index:id_version"`
-	Version        int    `gorm:"unique_index:id_version"`
-	BlockSize      int
-	NumberOfBlocks int
+	Name              string `gorm:"unique_index:id_version"`
+	Version           int    `gorm:"unique_index:id_version"`
+	BlockSize         int
+	NumberOfBlocks    int
+	ChecksumAlgorithm string // used to fingerprint the blocks of this version
+	IsContentDefined  bool   // if set, BlockSize is the maximum size of a block
+	Size              int64  // in bytes
+	CreatedAt         time.Time
+}
+
+// Pack is a file at Location holding the files of many blocks.
+type Pack struct {
+	ID       uint `gorm:"primary_key"`
+	Location string
+	Size     int64 // 0 until the pack is stored
+}
+
+// ParityGroup is a set of block files of an object version protected by
+// parity files, from which up to ParityShards missing or damaged files of the
+// group can be rebuilt.
+type ParityGroup struct {
+	ID           uint `gorm:"primary_key"`
+	ObjectName   string
+	Version      int
+	DataShards   int // how many block files are in the group
+	ParityShards int
+	ShardSize    int // block files are padded with zeros to this size
+}
+
+// ParityShard is a file of a ParityGroup: the file of a block if ShardIndex is
+// less than the group's DataShards, and a parity file otherwise.
+type ParityShard struct {
+	ParityGroupID uint `gorm:"unique_index:parity_group_shard_index"`
+	ShardIndex    int  `gorm:"unique_index:parity_group_shard_index"`
+	Location      string
+	Length        int
+	Checksum      string // SHA-256 of the file, which is already encrypted
+}
+
+// PendingStore is an object version whose files are being written. It is
+// deleted by the transaction that records the version, so one whose process
+// is gone belongs to a store that never completed.
+type PendingStore struct {
+	ID         uint   `gorm:"primary_key"`
+	ObjectName string `gorm:"unique_index:pending_store_version"`
+	Version    int    `gorm:"unique_index:pending_store_version"`
+	Hostname   string // of the machine storing the version
+	PID        int    // of the process storing the version
+	CreatedAt  time.Time
+}
+
+// StagedFile is a file written to the block store for a PendingStore, which
+// is recorded before the file is written, or a recorded file it reuses.
+type StagedFile struct {
+	PendingStoreID uint `gorm:"index"`
+	Location       string
+	DataKeyID      uint // of the reused file, or 0
+}
+
+// RetentionPolicy says which versions of the objects whose names match
+// Pattern, a glob as understood by path.Match, are kept when pruning. An empty
+// Pattern matches every object. A version is kept if any of the rules keeps it.
+type RetentionPolicy struct {
+	ID          uint   `gorm:"primary_key"`
+	Pattern     string `gorm:"unique_index"`
+	KeepLast    int    // newest versions
+	KeepDaily   int    // newest version of each of the last days with one
+	KeepWeekly  int    // likewise for ISO weeks
+	KeepMonthly int    // likewise for months
+}
+
+// DataKey is the Gorm model for the key used to encrypt an object's blocks.
+// The key itself is only ever stored wrapped by the master key.
+type DataKey struct {
+	ID         uint   `gorm:"primary_key"`
+	ObjectName string `gorm:"unique_index"`
+	WrappedKey []byte
+	Nonce      []byte
+	Tag        []byte
+}
+
+// MasterKeyInfo holds what is needed to derive and verify the master key. A
+// repository has at most one row.
+type MasterKeyInfo struct {
+	ID         uint   `gorm:"primary_key"`
+	Salt       []byte // empty if the master key is read from a keyfile
+	ScryptN    int
+	ScryptR    int
+	ScryptP    int
+	Check      []byte // a known value sealed by the master key
+	CheckNonce []byte
+	CheckTag   []byte
+
+	// ConvergenceSecret keys the fingerprints and block keys of convergently
+	// encrypted blocks. It is wrapped by the master key.
+	ConvergenceSecret      []byte
+	ConvergenceSecretNonce []byte
+	ConvergenceSecretTag   []byte
 }
@@ -0,0 +1,186 @@
+package edis
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+const latestVersionName = "latest"
+
+// MountedFilesystem is a read-only FUSE view of a repository, with one
+// directory per object holding one file per version and a "latest" symlink.
+type MountedFilesystem struct {
+	conn       *fuse.Conn
+	mountpoint string
+	served     chan error
+}
+
+// Mount mounts the repository at mountpoint and returns once the filesystem
+// is ready. Requests are served until it is unmounted.
+func (e *Engine) Mount(mountpoint string) (*MountedFilesystem, error) {
+	c, err := fuse.Mount(mountpoint, fuse.FSName("edis"), fuse.Subtype("edis"), fuse.ReadOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MountedFilesystem{
+		conn:       c,
+		mountpoint: mountpoint,
+		served:     make(chan error, 1),
+	}
+	go func() {
+		m.served <- fs.Serve(c, &objectFS{e})
+	}()
+
+	<-c.Ready
+	if c.MountError != nil {
+		c.Close()
+		return nil, c.MountError
+	}
+	return m, nil
+}
+
+// Wait blocks until the filesystem is unmounted.
+func (m *MountedFilesystem) Wait() error {
+	err := <-m.served
+	m.conn.Close()
+	return err
+}
+
+// Unmount unmounts the filesystem, which makes Wait return.
+func (m *MountedFilesystem) Unmount() error {
+	return fuse.Unmount(m.mountpoint)
+}
+
+// Object names may contain characters that cannot appear in a file name.
+var objectNameEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+var objectNameUnescaper = strings.NewReplacer("%25", "%", "%2F", "/")
+
+type objectFS struct {
+	e *Engine
+}
+
+func (f *objectFS) Root() (fs.Node, error) {
+	return &rootDir{f.e}, nil
+}
+
+type rootDir struct {
+	e *Engine
+}
+
+func (d *rootDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *rootDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	names, err := d.e.getObjectNames()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fuse.Dirent, len(names))
+	for i := range names {
+		entries[i] = fuse.Dirent{Name: objectNameEscaper.Replace(names[i]), Type: fuse.DT_Dir}
+	}
+	return entries, nil
+}
+
+func (d *rootDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	objectName := objectNameUnescaper.Replace(name)
+	isObjectNew, err := d.e.isObjectNew(objectName)
+	if err != nil {
+		return nil, err
+	}
+
+	if isObjectNew {
+		return nil, fuse.ENOENT
+	}
+	return &objectDir{d.e, objectName}, nil
+}
+
+type objectDir struct {
+	e    *Engine
+	name string
+}
+
+func (d *objectDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *objectDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	versions, err := d.e.getObjectVersions(d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []fuse.Dirent{{Name: latestVersionName, Type: fuse.DT_Link}}
+	for i := range versions {
+		entries = append(entries, fuse.Dirent{Name: strconv.Itoa(versions[i].Version), Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func (d *objectDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == latestVersionName {
+		return &latestLink{d.e, d.name}, nil
+	}
+
+	version, err := strconv.Atoi(name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+
+	r, err := d.e.OpenObject(d.name, version)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &versionFile{r}, nil
+}
+
+type latestLink struct {
+	e    *Engine
+	name string
+}
+
+func (l *latestLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeSymlink | 0444
+	return nil
+}
+
+func (l *latestLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	version, err := l.e.GetLatestVersionNumber(l.name)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(version), nil
+}
+
+// versionFile is both the node and the handle of an object version.
+type versionFile struct {
+	r *ObjectReader
+}
+
+func (f *versionFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	a.Size = uint64(f.r.Size())
+	return nil
+}
+
+func (f *versionFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	p := make([]byte, req.Size)
+	n, err := f.r.ReadAt(p, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	resp.Data = p[:n]
+	return nil
+}
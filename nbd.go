@@ -0,0 +1,518 @@
+package edis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Constants of the fixed newstyle NBD protocol, see
+// https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+const (
+	nbdMagic            = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptionMagic      = 0x49484156454f5054 // "IHAVEOPT"
+	nbdReplyMagic       = 0x3e889045565a9
+	nbdRequestMagic     = 0x25609513
+	nbdSimpleReplyMagic = 0x67446698
+
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	nbdFlagCNoZeroes = 1 << 1
+
+	nbdOptExportName = 1
+	nbdOptAbort      = 2
+	nbdOptList       = 3
+	nbdOptInfo       = 6
+	nbdOptGo         = 7
+
+	nbdRepAck        = 1
+	nbdRepServer     = 2
+	nbdRepInfo       = 3
+	nbdRepErrUnsup   = 1<<31 + 1
+	nbdRepErrInvalid = 1<<31 + 3
+	nbdRepErrUnknown = 1<<31 + 6
+
+	nbdInfoExport = 0
+
+	nbdFlagHasFlags  = 1 << 0
+	nbdFlagReadOnly  = 1 << 1
+	nbdFlagSendFlush = 1 << 2
+
+	nbdCmdRead  = 0
+	nbdCmdWrite = 1
+	nbdCmdDisc  = 2
+	nbdCmdFlush = 3
+
+	nbdEPERM  = 1
+	nbdEIO    = 5
+	nbdEINVAL = 22
+	nbdENOSPC = 28
+
+	nbdMaxOptionLength  = 4096
+	nbdMaxRequestLength = 32 * 1024 * 1024
+)
+
+const nbdLatestExportVersion = "latest"
+
+// ServeNBD exports object versions over the NBD protocol to the clients that
+// connect to listener, until it is closed. Exports are named OBJECT/VERSION
+// and are read-only. If isWritable is set, OBJECT/latest is a copy-on-write
+// export whose writes are saved as a new version of the object when the
+// client disconnects; otherwise it is the latest version, read-only.
+//
+// A failed connection does not stop the server; its error is passed to
+// onError, if it is not nil, along with the address of the client.
+func (e *Engine) ServeNBD(listener net.Listener, isWritable bool, onError func(client net.Addr, err error)) error {
+	s := &nbdServer{e: e, isWritable: isWritable}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			err := s.serve(conn)
+			if err != nil && onError != nil {
+				onError(conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+type nbdServer struct {
+	e          *Engine
+	isWritable bool
+	saving     sync.Mutex // new versions are saved one at a time
+}
+
+// nbdExport is an object version opened by a client.
+type nbdExport struct {
+	name      string
+	blockSize int
+	reader    *ObjectReader
+	overlay   *cowOverlay // nil for read-only exports
+}
+
+func (x *nbdExport) flags() uint16 {
+	flags := uint16(nbdFlagHasFlags | nbdFlagSendFlush)
+	if x.overlay == nil {
+		flags |= nbdFlagReadOnly
+	}
+	return flags
+}
+
+func (s *nbdServer) serve(conn net.Conn) error {
+	defer conn.Close()
+	export, err := s.negotiate(conn)
+	if err != nil || export == nil {
+		return err
+	}
+
+	err = s.transmit(conn, export)
+	if export.overlay == nil || !export.overlay.isDirty() {
+		return err
+	}
+
+	// Writes were acknowledged to the client, so keep them even if the
+	// connection was not closed cleanly.
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	saveErr := s.e.SaveObjectFromReader(io.NewSectionReader(export.overlay, 0, export.overlay.size), export.name, export.blockSize)
+	if saveErr != nil {
+		return fmt.Errorf("Could not save writes to %s as a new version: %v", export.name, saveErr)
+	}
+	return err
+}
+
+func (s *nbdServer) openExport(exportName string) (*nbdExport, error) {
+	i := strings.LastIndex(exportName, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("Export %s is not of the form OBJECT/VERSION or OBJECT/%s", exportName, nbdLatestExportVersion)
+	}
+
+	name := exportName[:i]
+	isLatest := exportName[i+1:] == nbdLatestExportVersion
+	var ov ObjectVersion
+	var err error
+	if isLatest {
+		ov, err = s.e.getLatestVersion(name)
+	} else {
+		var version int
+		version, err = strconv.Atoi(exportName[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Export %s has an invalid version", exportName)
+		}
+		ov, err = s.e.getObjectVersion(name, version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not find export %s", exportName)
+	}
+
+	r, err := s.e.OpenObject(name, ov.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &nbdExport{name: name, blockSize: ov.BlockSize, reader: r}
+	if isLatest && s.isWritable {
+		export.overlay = makeCowOverlay(r)
+	}
+	return export, nil
+}
+
+func (s *nbdServer) listExports() ([]string, error) {
+	names, err := s.e.getObjectNames()
+	if err != nil {
+		return []string{}, err
+	}
+
+	var exports []string
+	for i := 0; i < len(names); i++ {
+		versions, err := s.e.getObjectVersions(names[i])
+		if err != nil {
+			return []string{}, err
+		}
+
+		for j := 0; j < len(versions); j++ {
+			exports = append(exports, names[i]+"/"+strconv.Itoa(versions[j].Version))
+		}
+		exports = append(exports, names[i]+"/"+nbdLatestExportVersion)
+	}
+	return exports, nil
+}
+
+// negotiate runs the handshake and option haggling. It returns the export
+// the client chose, or nil if the client aborted.
+func (s *nbdServer) negotiate(conn net.Conn) (*nbdExport, error) {
+	err := binary.Write(conn, binary.BigEndian, struct {
+		Magic       uint64
+		OptionMagic uint64
+		Flags       uint16
+	}{nbdMagic, nbdOptionMagic, nbdFlagFixedNewstyle | nbdFlagNoZeroes})
+	if err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	err = binary.Read(conn, binary.BigEndian, &clientFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var header struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		err = binary.Read(conn, binary.BigEndian, &header)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Magic != nbdOptionMagic {
+			return nil, fmt.Errorf("Client sent an option with invalid magic %x", header.Magic)
+		}
+
+		if header.Length > nbdMaxOptionLength {
+			return nil, fmt.Errorf("Client sent an option of %d bytes", header.Length)
+		}
+
+		data := make([]byte, header.Length)
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Option {
+		case nbdOptExportName:
+			// There is no way to report an error for this option other
+			// than closing the connection.
+			export, err := s.openExport(string(data))
+			if err != nil {
+				return nil, err
+			}
+
+			err = binary.Write(conn, binary.BigEndian, struct {
+				Size  uint64
+				Flags uint16
+			}{uint64(export.reader.Size()), export.flags()})
+			if err == nil && clientFlags&nbdFlagCNoZeroes == 0 {
+				_, err = conn.Write(make([]byte, 124))
+			}
+			return export, err
+
+		case nbdOptAbort:
+			return nil, writeNBDOptionReply(conn, header.Option, nbdRepAck, nil)
+
+		case nbdOptList:
+			var exports []string
+			exports, err = s.listExports()
+			if err != nil {
+				return nil, err
+			}
+
+			for i := 0; i < len(exports); i++ {
+				p := make([]byte, 4, 4+len(exports[i]))
+				binary.BigEndian.PutUint32(p, uint32(len(exports[i])))
+				err = writeNBDOptionReply(conn, header.Option, nbdRepServer, append(p, exports[i]...))
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = writeNBDOptionReply(conn, header.Option, nbdRepAck, nil)
+
+		case nbdOptInfo, nbdOptGo:
+			var export *nbdExport
+			export, err = s.negotiateInfo(conn, header.Option, data)
+			if export != nil && header.Option == nbdOptGo {
+				return export, err
+			}
+
+		default:
+			err = writeNBDOptionReply(conn, header.Option, nbdRepErrUnsup, []byte("Unsupported option"))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// negotiateInfo answers NBD_OPT_INFO and NBD_OPT_GO. It returns the export
+// if it could be opened.
+func (s *nbdServer) negotiateInfo(conn net.Conn, option uint32, data []byte) (*nbdExport, error) {
+	if len(data) < 6 || 4+int(binary.BigEndian.Uint32(data))+2 > len(data) {
+		return nil, writeNBDOptionReply(conn, option, nbdRepErrInvalid, []byte("Malformed request"))
+	}
+
+	// Only NBD_INFO_EXPORT is sent, which servers must do regardless of the
+	// information requests that follow the name.
+	name := string(data[4 : 4+binary.BigEndian.Uint32(data)])
+	export, err := s.openExport(name)
+	if err != nil {
+		return nil, writeNBDOptionReply(conn, option, nbdRepErrUnknown, []byte(err.Error()))
+	}
+
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info, nbdInfoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(export.reader.Size()))
+	binary.BigEndian.PutUint16(info[10:], export.flags())
+	err = writeNBDOptionReply(conn, option, nbdRepInfo, info)
+	if err != nil {
+		return nil, err
+	}
+	return export, writeNBDOptionReply(conn, option, nbdRepAck, nil)
+}
+
+func writeNBDOptionReply(w io.Writer, option, replyType uint32, data []byte) error {
+	err := binary.Write(w, binary.BigEndian, struct {
+		Magic     uint64
+		Option    uint32
+		ReplyType uint32
+		Length    uint32
+	}{nbdReplyMagic, option, replyType, uint32(len(data))})
+	if err != nil || len(data) == 0 {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// transmit serves requests on export until the client disconnects.
+func (s *nbdServer) transmit(conn net.Conn, export *nbdExport) error {
+	var source io.ReaderAt = export.reader
+	if export.overlay != nil {
+		source = export.overlay
+	}
+
+	for {
+		var request struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		err := binary.Read(conn, binary.BigEndian, &request)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if request.Magic != nbdRequestMagic {
+			return fmt.Errorf("Client sent a request with invalid magic %x", request.Magic)
+		}
+
+		if request.Length > nbdMaxRequestLength {
+			return fmt.Errorf("Client sent a request of %d bytes", request.Length)
+		}
+
+		isInBounds := request.Offset+uint64(request.Length) <= uint64(export.reader.Size())
+		switch request.Type {
+		case nbdCmdRead:
+			if !isInBounds {
+				err = writeNBDReply(conn, request.Handle, nbdEINVAL, nil)
+				break
+			}
+
+			p := make([]byte, request.Length)
+			_, err = source.ReadAt(p, int64(request.Offset))
+			if err != nil && err != io.EOF {
+				err = writeNBDReply(conn, request.Handle, nbdEIO, nil)
+				break
+			}
+			err = writeNBDReply(conn, request.Handle, 0, p)
+
+		case nbdCmdWrite:
+			// The data must be consumed even if the write is refused.
+			p := make([]byte, request.Length)
+			_, err = io.ReadFull(conn, p)
+			if err != nil {
+				return err
+			}
+
+			if export.overlay == nil {
+				err = writeNBDReply(conn, request.Handle, nbdEPERM, nil)
+				break
+			}
+
+			if !isInBounds {
+				err = writeNBDReply(conn, request.Handle, nbdENOSPC, nil)
+				break
+			}
+
+			_, err = export.overlay.WriteAt(p, int64(request.Offset))
+			if err != nil {
+				err = writeNBDReply(conn, request.Handle, nbdEIO, nil)
+				break
+			}
+			err = writeNBDReply(conn, request.Handle, 0, nil)
+
+		case nbdCmdFlush:
+			// Writes are only persisted on disconnect.
+			err = writeNBDReply(conn, request.Handle, 0, nil)
+
+		case nbdCmdDisc:
+			return nil
+
+		default:
+			err = writeNBDReply(conn, request.Handle, nbdEINVAL, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeNBDReply(w io.Writer, handle uint64, errno uint32, data []byte) error {
+	err := binary.Write(w, binary.BigEndian, struct {
+		Magic  uint32
+		Error  uint32
+		Handle uint64
+	}{nbdSimpleReplyMagic, errno, handle})
+	if err != nil || len(data) == 0 {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+const cowPageSize = 4096
+
+// cowOverlay keeps the pages written to an object version in memory, on top
+// of the unmodified version.
+type cowOverlay struct {
+	sync.Mutex
+	base  *ObjectReader
+	size  int64
+	pages map[int64][]byte // keyed by page number
+}
+
+func makeCowOverlay(base *ObjectReader) *cowOverlay {
+	return &cowOverlay{
+		base:  base,
+		size:  base.Size(),
+		pages: make(map[int64][]byte),
+	}
+}
+
+func (o *cowOverlay) isDirty() bool {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.pages) > 0
+}
+
+// loadPage returns the current content of a page, which is shorter than
+// cowPageSize at the end of the object.
+func (o *cowOverlay) loadPage(number int64) ([]byte, error) {
+	if page, found := o.pages[number]; found {
+		return page, nil
+	}
+
+	off := number * cowPageSize
+	length := int64(cowPageSize)
+	if off+length > o.size {
+		length = o.size - off
+	}
+
+	page := make([]byte, length)
+	_, err := o.base.ReadAt(page, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return page, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (o *cowOverlay) ReadAt(p []byte, off int64) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	n := 0
+	for n < len(p) && off+int64(n) < o.size {
+		position := off + int64(n)
+		page, err := o.loadPage(position / cowPageSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], page[position%cowPageSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt. Writes cannot grow the object.
+func (o *cowOverlay) WriteAt(p []byte, off int64) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	if off < 0 || off+int64(len(p)) > o.size {
+		return 0, fmt.Errorf("Cannot write %d bytes at offset %d of a %d byte object", len(p), off, o.size)
+	}
+
+	n := 0
+	for n < len(p) {
+		position := off + int64(n)
+		number := position / cowPageSize
+		page, err := o.loadPage(number)
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(page[position%cowPageSize:], p[n:])
+		o.pages[number] = page
+	}
+	return n, nil
+}
@@ -0,0 +1,205 @@
+package edis
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+const defaultBlockCacheSize = 8
+
+// blockCache is an LRU cache of decoded blocks, keyed by block index.
+type blockCache struct {
+	sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used
+	entries  map[int]*list.Element
+}
+
+type blockCacheEntry struct {
+	index int
+	p     []byte
+}
+
+func makeBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[int]*list.Element),
+	}
+}
+
+func (c *blockCache) get(index int) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, found := c.entries[index]
+	if !found {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(blockCacheEntry).p, true
+}
+
+func (c *blockCache) put(index int, p []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if element, found := c.entries[index]; found {
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[index] = c.order.PushFront(blockCacheEntry{index, p})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(blockCacheEntry).index)
+	}
+}
+
+// ObjectReader gives random access to a stored object version. Only the
+// blocks that are touched are read and decrypted, and the most recently used
+// ones are kept in memory.
+type ObjectReader struct {
+	e        *Engine
+	blocks   []Block
+	offsets  []int64 // offsets[i] is where blocks[i] starts; the last entry is the size
+	cache    *blockCache
+	position int64
+}
+
+// OpenObject returns an ObjectReader over a particular object version.
+func (e *Engine) OpenObject(name string, version int) (*ObjectReader, error) {
+	ov, err := e.getObjectVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := e.loadBlockInfos(name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, len(blocks)+1)
+	for i := 0; i < len(blocks); i++ {
+		offsets[i] = getBlockOffset(blocks[i], ov.BlockSize)
+		length, err := e.getBlockLength(blocks[i], ov)
+		if err != nil {
+			return nil, err
+		}
+		offsets[i+1] = offsets[i] + length
+	}
+
+	return &ObjectReader{
+		e:       e,
+		blocks:  blocks,
+		offsets: offsets,
+		cache:   makeBlockCache(defaultBlockCacheSize),
+	}, nil
+}
+
+// getBlockLength returns the uncompressed length of b, a block of ov. Blocks
+// stored before lengths were recorded are full unless they are the last one,
+// and are never compressed.
+func (e *Engine) getBlockLength(b Block, ov ObjectVersion) (int64, error) {
+	if b.ByteLength != 0 {
+		return int64(b.ByteLength), nil
+	}
+
+	if b.BlockIndex < ov.NumberOfBlocks-1 {
+		return int64(ov.BlockSize), nil
+	}
+
+	p, err := e.store.Get(b.Location)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(p)), nil
+}
+
+// Size returns the size of the object version in bytes.
+func (r *ObjectReader) Size() int64 {
+	return r.offsets[len(r.offsets)-1]
+}
+
+func (r *ObjectReader) loadBlock(i int) ([]byte, error) {
+	if p, found := r.cache.get(i); found {
+		return p, nil
+	}
+
+	p, err := r.e.readBlock(r.blocks[i])
+	if err != nil {
+		return nil, err
+	}
+
+	r.cache.put(i, p)
+	return p, nil
+}
+
+// ReadAt implements io.ReaderAt. It is safe to call concurrently.
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("Cannot read at negative offset %d", off)
+	}
+
+	// The first block that ends after off.
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.offsets[i+1] > off
+	})
+
+	n := 0
+	for ; n < len(p) && i < len(r.blocks); i++ {
+		block, err := r.loadBlock(i)
+		if err != nil {
+			return n, err
+		}
+
+		start := off + int64(n) - r.offsets[i]
+		if start > int64(len(block)) {
+			return n, fmt.Errorf("Block %d is shorter than expected", i)
+		}
+		n += copy(p[n:], block[start:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.position >= r.Size() {
+		return 0, io.EOF
+	}
+
+	n, err := r.ReadAt(p, r.position)
+	r.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.position + offset
+	case io.SeekEnd:
+		position = r.Size() + offset
+	default:
+		return r.position, fmt.Errorf("Invalid whence %d", whence)
+	}
+
+	if position < 0 {
+		return r.position, fmt.Errorf("Cannot seek to negative position %d", position)
+	}
+
+	r.position = position
+	return position, nil
+}
@@ -0,0 +1,341 @@
+package edis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// DefaultPackSize is the size packs are filled up to when repacking without a
+// configured pack size.
+const DefaultPackSize = 64 * 1024 * 1024
+
+// A pack is repacked if less than this fraction of it is still used.
+const minPackUtilization = 0.5
+
+var packMagic = []byte("EDISPACK")
+
+// A pack file holds the encrypted files of many blocks back to back, followed
+// by an index of them and a trailer:
+//
+//	block files
+//	index entries: offset (uint64), length (uint32), checksum length (uint16), checksum
+//	trailer: number of entries (uint32), offset of the index (uint64), "EDISPACK"
+//
+// The database is what blocks are read through; the index is there so that a
+// pack can be made sense of without it.
+type packIndexEntry struct {
+	offset   int64
+	length   int
+	checksum string
+}
+
+const packTrailerSize = 4 + 8 + 8
+
+func encodePackIndex(entries []packIndexEntry, indexOffset int64) []byte {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		binary.Write(&buffer, binary.BigEndian, uint64(entry.offset))
+		binary.Write(&buffer, binary.BigEndian, uint32(entry.length))
+		binary.Write(&buffer, binary.BigEndian, uint16(len(entry.checksum)))
+		buffer.WriteString(entry.checksum)
+	}
+
+	binary.Write(&buffer, binary.BigEndian, uint32(len(entries)))
+	binary.Write(&buffer, binary.BigEndian, uint64(indexOffset))
+	buffer.Write(packMagic)
+	return buffer.Bytes()
+}
+
+// readPackIndex returns the index of the pack p.
+func readPackIndex(p []byte) ([]packIndexEntry, error) {
+	if len(p) < packTrailerSize || !bytes.Equal(p[len(p)-len(packMagic):], packMagic) {
+		return nil, fmt.Errorf("Pack has no valid trailer")
+	}
+
+	trailer := p[len(p)-packTrailerSize:]
+	count := int(binary.BigEndian.Uint32(trailer))
+	indexOffset := binary.BigEndian.Uint64(trailer[4:])
+	if indexOffset > uint64(len(p)-packTrailerSize) {
+		return nil, fmt.Errorf("Pack index starts at invalid offset %d", indexOffset)
+	}
+
+	index := bytes.NewReader(p[indexOffset : len(p)-packTrailerSize])
+	entries := make([]packIndexEntry, count)
+	for i := 0; i < count; i++ {
+		var header struct {
+			Offset         uint64
+			Length         uint32
+			ChecksumLength uint16
+		}
+		err := binary.Read(index, binary.BigEndian, &header)
+		if err != nil {
+			return nil, fmt.Errorf("Pack index is truncated: %v", err)
+		}
+
+		checksum := make([]byte, header.ChecksumLength)
+		_, err = index.Read(checksum)
+		if err != nil {
+			return nil, fmt.Errorf("Pack index is truncated: %v", err)
+		}
+		entries[i] = packIndexEntry{int64(header.Offset), int(header.Length), string(checksum)}
+	}
+	return entries, nil
+}
+
+// packWriter appends block files to a pack until it is full, then stores it
+// and starts another.
+type packWriter struct {
+	sync.Mutex
+	e       *Engine
+	ov      ObjectVersion // being stored, if the packs are staged for it
+	size    int
+	pack    *Pack // nil until a block is added
+	buffer  bytes.Buffer
+	entries []packIndexEntry
+}
+
+// makePackWriter returns a packWriter that fills packs up to size bytes with
+// the block files of ov, or nil if size is 0 and blocks are stored in files of
+// their own.
+func (e *Engine) makePackWriter(ov ObjectVersion, size int) (*packWriter, error) {
+	if size == 0 {
+		return nil, nil
+	}
+
+	if e.c.IsDirectIOEnabled {
+		return nil, fmt.Errorf("DirectIO cannot be used with packs")
+	}
+	return &packWriter{e: e, ov: ov, size: size}, nil
+}
+
+// add appends the file of b to the current pack and sets where it is in b.
+func (w *packWriter) add(b *Block, ciphertext []byte) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.pack == nil {
+		name := make([]byte, 16)
+		_, err := rand.Read(name)
+		if err != nil {
+			return err
+		}
+
+		w.pack = &Pack{Location: "packs/" + hex.EncodeToString(name) + ".pack"}
+		err = w.e.db.Create(w.pack).Error
+		if err == nil {
+			err = w.e.stageFile(w.ov, w.pack.Location)
+		}
+
+		if err != nil {
+			w.pack = nil
+			return err
+		}
+	}
+
+	b.Location = w.pack.Location
+	b.PackID = w.pack.ID
+	b.PackOffset = int64(w.buffer.Len())
+	w.entries = append(w.entries, packIndexEntry{b.PackOffset, len(ciphertext), b.Checksum})
+	w.buffer.Write(ciphertext)
+	if w.buffer.Len() >= w.size {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+// flush stores the current pack, if any.
+func (w *packWriter) flush() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.flushLocked()
+}
+
+func (w *packWriter) flushLocked() error {
+	if w.pack == nil {
+		return nil
+	}
+
+	w.buffer.Write(encodePackIndex(w.entries, int64(w.buffer.Len())))
+	err := w.e.store.Put(w.pack.Location, w.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	w.pack.Size = int64(w.buffer.Len())
+	err = w.e.db.Save(w.pack).Error
+	w.pack = nil
+	w.buffer.Reset()
+	w.entries = nil
+	return err
+}
+
+// readPackedBlock reads the file of b from its pack.
+func (e *Engine) readPackedBlock(b Block) ([]byte, error) {
+	return e.store.GetRange(b.Location, b.PackOffset, b.StoredLength)
+}
+
+// Repack consolidates packs that are mostly unused, after the blocks in them
+// were deleted, or that are smaller than half the pack size, into new packs,
+// and deletes packs that are not used at all. It returns how many packs were
+// removed.
+//
+// Repacking moves files recorded blocks use, so it refuses to start while
+// objects are being stored or garbage is being collected, and neither must
+// start before it is done.
+func (e *Engine) Repack() (int, error) {
+	repack, err := e.beginMaintenance()
+	if err != nil {
+		return 0, fmt.Errorf("Could not start repacking while packs are being repacked or garbage is being collected: %v", err)
+	}
+
+	var count int
+	err = e.db.Model(&PendingStore{}).Where("id != ?", repack.ID).Count(&count).Error
+	if err == nil && count > 0 {
+		err = fmt.Errorf("Could not start repacking while %d objects are being stored", count)
+	}
+
+	if err != nil {
+		return 0, e.abandonStoreOnError(repack, err)
+	}
+
+	removed, err := e.repack()
+	if err != nil {
+		return removed, e.abandonStoreOnError(repack, err)
+	}
+	return removed, deletePendingStore(e.db, repack)
+}
+
+func (e *Engine) repack() (int, error) {
+	size := e.c.PackSize
+	if size == 0 {
+		size = DefaultPackSize
+	}
+
+	var packs []Pack
+	err := e.db.Find(&packs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var staged []StagedFile
+	err = e.db.Find(&staged).Error
+	if err != nil {
+		return 0, err
+	}
+
+	isStaged := make(map[string]bool)
+	for i := 0; i < len(staged); i++ {
+		isStaged[staged[i].Location] = true
+	}
+
+	// The new packs are staged for the repack, so that they are removed if
+	// it does not complete.
+	w, err := e.makePackWriter(ObjectVersion{}, size)
+	if err != nil {
+		return 0, err
+	}
+
+	type candidate struct {
+		pack           Pack
+		files          map[int64]Block // one block per file, by offset
+		isMostlyUnused bool
+	}
+	var candidates []candidate
+	for i := 0; i < len(packs); i++ {
+		// Packs that were never stored are still being written, and staged
+		// ones may be about to be used by a store.
+		if packs[i].Size == 0 || isStaged[packs[i].Location] {
+			continue
+		}
+
+		var blocks []Block
+		err = e.db.Where("pack_id = ?", packs[i].ID).Find(&blocks).Error
+		if err != nil {
+			return 0, err
+		}
+
+		// Blocks with the same content share a file in the pack.
+		used := int64(0)
+		files := make(map[int64]Block)
+		for j := 0; j < len(blocks); j++ {
+			if _, found := files[blocks[j].PackOffset]; !found {
+				files[blocks[j].PackOffset] = blocks[j]
+				used += int64(blocks[j].StoredLength)
+			}
+		}
+
+		isMostlyUnused := float64(used) < minPackUtilization*float64(packs[i].Size)
+		isSmall := packs[i].Size < int64(size/2)
+		if isMostlyUnused || isSmall {
+			candidates = append(candidates, candidate{packs[i], files, isMostlyUnused})
+		}
+	}
+
+	// A single small pack would only be copied into another one.
+	if len(candidates) == 1 && !candidates[0].isMostlyUnused {
+		return 0, nil
+	}
+
+	type move struct {
+		from Block
+		to   Block
+	}
+	var moves []move
+	var repacked []Pack
+	for _, c := range candidates {
+		for _, b := range c.files {
+			ciphertext, err := e.readPackedBlock(b)
+			if err != nil {
+				return 0, err
+			}
+
+			moved := b
+			err = w.add(&moved, ciphertext)
+			if err != nil {
+				return 0, err
+			}
+			moves = append(moves, move{b, moved})
+		}
+		repacked = append(repacked, c.pack)
+	}
+
+	// The new packs must be stored before blocks point at them, and blocks
+	// must point at them before the old packs are deleted.
+	err = w.flush()
+	if err != nil {
+		return 0, err
+	}
+
+	tx := e.db.Begin()
+	for i := 0; i < len(moves); i++ {
+		err = tx.Exec("UPDATE blocks SET location = ?, pack_id = ?, pack_offset = ? "+
+			"WHERE pack_id = ? AND pack_offset = ?",
+			moves[i].to.Location, moves[i].to.PackID, moves[i].to.PackOffset,
+			moves[i].from.PackID, moves[i].from.PackOffset).Error
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < len(repacked); i++ {
+		err = e.store.Delete(repacked[i].Location)
+		if err != nil {
+			return i, err
+		}
+
+		err = e.db.Delete(&repacked[i]).Error
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(repacked), nil
+}
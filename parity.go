@@ -0,0 +1,339 @@
+package edis
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/klauspost/reedsolomon"
+)
+
+// Reed-Solomon codes over GF(2^8) cannot have more shards than this.
+const maxShards = 256
+
+type parityMember struct {
+	location   string
+	ciphertext []byte
+}
+
+// parityWriter collects the block files of an object version as they are
+// stored, and stores parity files for every DataShards of them.
+type parityWriter struct {
+	sync.Mutex
+	e            *Engine
+	ov           ObjectVersion
+	dataShards   int
+	parityShards int
+	members      []parityMember
+}
+
+// makeParityWriter returns a parityWriter for ov, or nil if parityShards is 0
+// and block files are not protected.
+func (e *Engine) makeParityWriter(ov ObjectVersion, dataShards, parityShards int) (*parityWriter, error) {
+	if parityShards == 0 {
+		return nil, nil
+	}
+
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > maxShards {
+		return nil, fmt.Errorf("Parity groups must have at least one data shard and at most %d shards, got %d and %d",
+			maxShards, dataShards, parityShards)
+	}
+
+	if e.c.PackSize != 0 {
+		return nil, fmt.Errorf("Packs cannot be protected by parity files")
+	}
+	return &parityWriter{e: e, ov: ov, dataShards: dataShards, parityShards: parityShards}, nil
+}
+
+// add adds the block file at location, which holds ciphertext, to the
+// current group.
+func (w *parityWriter) add(location string, ciphertext []byte) error {
+	w.Lock()
+	defer w.Unlock()
+	w.members = append(w.members, parityMember{location, ciphertext})
+	if len(w.members) >= w.dataShards {
+		return w.flushLocked()
+	}
+	return nil
+}
+
+// flush stores the parity files of the current group, if any.
+func (w *parityWriter) flush() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.flushLocked()
+}
+
+func (w *parityWriter) flushLocked() error {
+	if len(w.members) == 0 {
+		return nil
+	}
+
+	members := w.members
+	w.members = nil
+	group := ParityGroup{
+		ObjectName:   w.ov.Name,
+		Version:      w.ov.Version,
+		DataShards:   len(members),
+		ParityShards: w.parityShards,
+	}
+	for _, m := range members {
+		if len(m.ciphertext) > group.ShardSize {
+			group.ShardSize = len(m.ciphertext)
+		}
+	}
+
+	enc, err := reedsolomon.New(group.DataShards, group.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	shards := make([][]byte, group.DataShards+group.ParityShards)
+	var rows []ParityShard
+	for i, m := range members {
+		shards[i] = make([]byte, group.ShardSize)
+		copy(shards[i], m.ciphertext)
+		rows = append(rows, ParityShard{ShardIndex: i, Location: m.location, Length: len(m.ciphertext),
+			Checksum: computeShardChecksum(m.ciphertext)})
+	}
+	for i := group.DataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, group.ShardSize)
+	}
+
+	err = enc.Encode(shards)
+	if err != nil {
+		return err
+	}
+
+	// Parity files are stored before the group is recorded, so a failure
+	// leaves staged files rather than a group without them.
+	for i := group.DataShards; i < len(shards); i++ {
+		name := make([]byte, 16)
+		_, err = rand.Read(name)
+		if err != nil {
+			return err
+		}
+
+		location := "parity/" + hex.EncodeToString(name) + ".edis"
+		err = w.e.stageFile(w.ov, location)
+		if err != nil {
+			return err
+		}
+
+		err = w.e.store.Put(location, shards[i])
+		if err != nil {
+			return err
+		}
+		rows = append(rows, ParityShard{ShardIndex: i, Location: location, Length: group.ShardSize,
+			Checksum: computeShardChecksum(shards[i])})
+	}
+
+	tx := w.e.db.Begin()
+	err = tx.Create(&group).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i := 0; i < len(rows); i++ {
+		rows[i].ParityGroupID = group.ID
+		err = tx.Create(&rows[i]).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func computeShardChecksum(p []byte) string {
+	hash := sha256.Sum256(p)
+	return hex.EncodeToString(hash[:])
+}
+
+// detachParityShards records that the block file at location, which is about
+// to be replaced, is no longer the one its parity groups protect.
+func (e *Engine) detachParityShards(location string) error {
+	return e.db.Exec("UPDATE parity_shards SET location = '' WHERE location = ?", location).Error
+}
+
+// getParityGroups returns every parity group along with its shards, in order.
+func getParityGroups(db *gorm.DB) ([]ParityGroup, map[uint][]ParityShard, error) {
+	var groups []ParityGroup
+	err := db.Find(&groups).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var all []ParityShard
+	err = db.Order("shard_index").Find(&all).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shards := make(map[uint][]ParityShard)
+	for i := 0; i < len(all); i++ {
+		shards[all[i].ParityGroupID] = append(shards[all[i].ParityGroupID], all[i])
+	}
+	return groups, shards, nil
+}
+
+// isParityGroupUsed reports whether a block file of g is still in isUsed.
+func isParityGroupUsed(g ParityGroup, shards []ParityShard, isUsed map[string]bool) bool {
+	for _, s := range shards {
+		if s.ShardIndex < g.DataShards && isUsed[s.Location] {
+			return true
+		}
+	}
+	return false
+}
+
+// addUsedParityLocations adds the parity files of groups that still protect
+// a used block file to isUsed.
+func addUsedParityLocations(groups []ParityGroup, shards map[uint][]ParityShard, isUsed map[string]bool) {
+	for _, g := range groups {
+		if !isParityGroupUsed(g, shards[g.ID], isUsed) {
+			continue
+		}
+
+		for _, s := range shards[g.ID] {
+			if s.ShardIndex >= g.DataShards {
+				isUsed[s.Location] = true
+			}
+		}
+	}
+}
+
+// deleteUnusedParityGroups forgets the groups that protect no used block file.
+func (e *Engine) deleteUnusedParityGroups(groups []ParityGroup, shards map[uint][]ParityShard, isUsed map[string]bool) error {
+	for i := 0; i < len(groups); i++ {
+		if isParityGroupUsed(groups[i], shards[groups[i].ID], isUsed) {
+			continue
+		}
+
+		err := e.db.Exec("DELETE FROM parity_shards WHERE parity_group_id = ?", groups[i].ID).Error
+		if err != nil {
+			return err
+		}
+
+		err = e.db.Delete(&groups[i]).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScrubReport lists the damaged files Scrub found. Each entry describes one
+// file or group.
+type ScrubReport struct {
+	Groups        int      // parity groups checked
+	Damaged       []string // files that are missing or changed
+	Repaired      []string // damaged files that were rebuilt
+	Unrecoverable []string // groups with too many damaged files to rebuild
+}
+
+// Scrub reads every file of every parity group still in use and checks it
+// against its checksum. If isRepairing is set, missing or damaged files are
+// rebuilt from the rest of their group. Block files that were removed by
+// CollectGarbage are not rebuilt, and count against how many files of their
+// group can be.
+func (e *Engine) Scrub(isRepairing bool) (ScrubReport, error) {
+	report := ScrubReport{}
+	usage, err := e.getUsage()
+	if err != nil {
+		return report, err
+	}
+
+	isUsed, shards := usage.isUsed, usage.shards
+	for _, g := range usage.groups {
+		if !isParityGroupUsed(g, shards[g.ID], isUsed) {
+			continue
+		}
+
+		report.Groups++
+		data := make([][]byte, g.DataShards+g.ParityShards)
+		available := 0
+		var damaged []ParityShard
+		for _, s := range shards[g.ID] {
+			if !isUsed[s.Location] {
+				continue
+			}
+
+			p, err := e.readShard(s)
+			if err != nil {
+				return report, err
+			} else if p == nil {
+				damaged = append(damaged, s)
+				report.Damaged = append(report.Damaged, describeShard(g, s))
+				continue
+			}
+
+			data[s.ShardIndex] = make([]byte, g.ShardSize)
+			copy(data[s.ShardIndex], p)
+			available++
+		}
+
+		if len(damaged) == 0 {
+			continue
+		}
+
+		if available < g.DataShards {
+			report.Unrecoverable = append(report.Unrecoverable,
+				fmt.Sprintf("parity group %d of %s version %d: only %d of %d needed files are intact",
+					g.ID, g.ObjectName, g.Version, available, g.DataShards))
+			continue
+		}
+
+		if !isRepairing {
+			continue
+		}
+
+		enc, err := reedsolomon.New(g.DataShards, g.ParityShards)
+		if err != nil {
+			return report, err
+		}
+
+		err = enc.Reconstruct(data)
+		if err != nil {
+			return report, err
+		}
+
+		for _, s := range damaged {
+			p := data[s.ShardIndex][:s.Length]
+			if computeShardChecksum(p) != s.Checksum {
+				return report, fmt.Errorf("Rebuilt %s does not match its checksum", describeShard(g, s))
+			}
+
+			err = e.store.Put(s.Location, p)
+			if err != nil {
+				return report, err
+			}
+			report.Repaired = append(report.Repaired, describeShard(g, s))
+		}
+	}
+	return report, nil
+}
+
+// readShard returns the file of s, or nil if it is missing or damaged.
+func (e *Engine) readShard(s ParityShard) ([]byte, error) {
+	p, err := e.store.Get(s.Location)
+	if err != nil {
+		// A file that cannot be read is as good as damaged, unless the
+		// store cannot be reached at all.
+		_, err = e.store.Exists(s.Location)
+		return nil, err
+	}
+
+	if len(p) != s.Length || computeShardChecksum(p) != s.Checksum {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func describeShard(g ParityGroup, s ParityShard) string {
+	return fmt.Sprintf("%s (shard %d of parity group %d of %s version %d)", s.Location, s.ShardIndex, g.ID, g.ObjectName, g.Version)
+}
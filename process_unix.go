@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package edis
+
+import "syscall"
+
+// isProcessRunning reports whether a process with the given ID exists.
+func isProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package edis
+
+import "os"
+
+// isProcessRunning reports whether a process with the given ID exists.
+func isProcessRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	p.Release()
+	return true
+}
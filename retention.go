@@ -0,0 +1,187 @@
+package edis
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migrateCreationTimes gives versions stored before creation times were
+// recorded the Unix epoch as theirs, so they count as the oldest ones.
+func migrateCreationTimes(db *gorm.DB) error {
+	return db.Exec("UPDATE object_versions SET created_at = ? WHERE created_at IS NULL",
+		time.Unix(0, 0).UTC()).Error
+}
+
+// matches reports whether p applies to the object with the given name. An
+// empty pattern applies to every object, including those with a "/" in their
+// name, which no glob matches.
+func (p RetentionPolicy) matches(name string) bool {
+	if p.Pattern == "" {
+		return true
+	}
+
+	isMatch, _ := path.Match(p.Pattern, name)
+	return isMatch
+}
+
+func (p RetentionPolicy) validate() error {
+	_, err := path.Match(p.Pattern, "")
+	if err != nil {
+		return fmt.Errorf("Invalid object name pattern %s: %v", p.Pattern, err)
+	}
+
+	if p.KeepLast < 0 || p.KeepDaily < 0 || p.KeepWeekly < 0 || p.KeepMonthly < 0 {
+		return fmt.Errorf("Retention policy for %s keeps a negative number of versions", p.Pattern)
+	}
+
+	if p.KeepLast+p.KeepDaily+p.KeepWeekly+p.KeepMonthly == 0 {
+		return fmt.Errorf("Retention policy for %s does not keep any versions", p.Pattern)
+	}
+	return nil
+}
+
+// SetRetentionPolicy stores p, replacing any policy with the same pattern.
+func (e *Engine) SetRetentionPolicy(p RetentionPolicy) error {
+	err := p.validate()
+	if err != nil {
+		return err
+	}
+
+	var found []RetentionPolicy
+	err = e.db.Find(&found, &RetentionPolicy{
+		Pattern: p.Pattern,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if len(found) > 0 {
+		p.ID = found[0].ID
+		return e.db.Save(&p).Error
+	}
+
+	p.ID = 0
+	return e.db.Create(&p).Error
+}
+
+// GetRetentionPolicies returns the stored retention policies.
+func (e *Engine) GetRetentionPolicies() ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	err := e.db.Find(&policies).Error
+	if err != nil {
+		return []RetentionPolicy{}, err
+	}
+	return policies, nil
+}
+
+// findRetentionPolicy returns the policy that applies to the object with the
+// given name: the one naming it exactly, or else the longest matching pattern,
+// an empty pattern being the least specific.
+func findRetentionPolicy(policies []RetentionPolicy, name string) (RetentionPolicy, bool) {
+	var best RetentionPolicy
+	isFound := false
+	for _, p := range policies {
+		if p.Pattern == name {
+			return p, true
+		}
+
+		if p.matches(name) && (!isFound || len(p.Pattern) > len(best.Pattern)) {
+			best = p
+			isFound = true
+		}
+	}
+	return best, isFound
+}
+
+// Prune deletes the versions of objects that the policy applying to them
+// does not keep, and returns them. Objects no policy applies to are left
+// alone. If isDryRun is set, nothing is deleted. Block files are only removed
+// by CollectGarbage.
+func (e *Engine) Prune(policies []RetentionPolicy, isDryRun bool) ([]ObjectVersion, error) {
+	for _, p := range policies {
+		err := p.validate()
+		if err != nil {
+			return []ObjectVersion{}, err
+		}
+	}
+
+	names, err := e.getObjectNames()
+	if err != nil {
+		return []ObjectVersion{}, err
+	}
+
+	var dropped []ObjectVersion
+	for _, name := range names {
+		p, isFound := findRetentionPolicy(policies, name)
+		if !isFound {
+			continue
+		}
+
+		versions, err := e.getObjectVersions(name)
+		if err != nil {
+			return dropped, err
+		}
+
+		isKept := selectVersionsToKeep(versions, p)
+		for i := 0; i < len(versions); i++ {
+			if isKept[versions[i].Version] {
+				continue
+			}
+
+			if !isDryRun {
+				err = e.DeleteObjectVersion(name, versions[i].Version)
+				if err != nil {
+					return dropped, err
+				}
+			}
+			dropped = append(dropped, versions[i])
+		}
+	}
+	return dropped, nil
+}
+
+// selectVersionsToKeep returns the version numbers of versions that p keeps.
+func selectVersionsToKeep(versions []ObjectVersion, p RetentionPolicy) map[int]bool {
+	newest := append([]ObjectVersion{}, versions...)
+	sort.Slice(newest, func(i, j int) bool {
+		if !newest[i].CreatedAt.Equal(newest[j].CreatedAt) {
+			return newest[i].CreatedAt.After(newest[j].CreatedAt)
+		}
+		return newest[i].Version > newest[j].Version
+	})
+
+	isKept := make(map[int]bool)
+	for i := 0; i < len(newest) && i < p.KeepLast; i++ {
+		isKept[newest[i].Version] = true
+	}
+
+	keepNewestOfEachPeriod(newest, p.KeepDaily, isKept, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewestOfEachPeriod(newest, p.KeepWeekly, isKept, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepNewestOfEachPeriod(newest, p.KeepMonthly, isKept, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	return isKept
+}
+
+// keepNewestOfEachPeriod keeps the newest version of each of the last count
+// periods that have one. newest must be sorted newest first.
+func keepNewestOfEachPeriod(newest []ObjectVersion, count int, isKept map[int]bool, period func(t time.Time) string) {
+	last := ""
+	for i := 0; i < len(newest) && count > 0; i++ {
+		current := period(newest[i].CreatedAt.Local())
+		if current != last {
+			isKept[newest[i].Version] = true
+			last = current
+			count--
+		}
+	}
+}
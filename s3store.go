@@ -0,0 +1,197 @@
+package edis
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Configuration describes a bucket of an S3-compatible service, such as AWS,
+// MinIO or Ceph RGW, to keep blocks in.
+type S3Configuration struct {
+	Bucket   string
+	Prefix   string // prepended to the key of every block
+	Endpoint string // empty for AWS
+	Region   string
+
+	// AccessKeyID and SecretAccessKey are the credentials to use. If they
+	// are empty, credentials are taken from the environment or the shared
+	// AWS configuration files.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// IsPathStyle addresses the bucket as part of the path instead of the
+	// host name, which MinIO and most stand-ins need.
+	IsPathStyle bool
+
+	// Blocks larger than PartSize are uploaded and downloaded in parts of
+	// PartSize bytes, Concurrency of them at a time.
+	PartSize    int64
+	Concurrency int
+}
+
+type s3BlockStore struct {
+	c          S3Configuration
+	client     *s3.S3
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+// MakeS3BlockStore returns a BlockStore that keeps blocks as objects of an
+// S3 bucket.
+func MakeS3BlockStore(c S3Configuration) (BlockStore, error) {
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("No S3 bucket was given")
+	}
+
+	if c.PartSize == 0 {
+		c.PartSize = s3manager.DefaultUploadPartSize
+	} else if c.PartSize < s3manager.MinUploadPartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes, got %d", s3manager.MinUploadPartSize, c.PartSize)
+	}
+
+	if c.Concurrency <= 0 {
+		c.Concurrency = s3manager.DefaultUploadConcurrency
+	}
+
+	config := &aws.Config{
+		Region:           aws.String(c.Region),
+		S3ForcePathStyle: aws.Bool(c.IsPathStyle),
+	}
+	if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.AccessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(sess)
+	return &s3BlockStore{
+		c:      c,
+		client: client,
+		uploader: s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+			u.PartSize = c.PartSize
+			u.Concurrency = c.Concurrency
+		}),
+		downloader: s3manager.NewDownloaderWithClient(client, func(d *s3manager.Downloader) {
+			d.PartSize = c.PartSize
+			d.Concurrency = c.Concurrency
+		}),
+	}, nil
+}
+
+func (s *s3BlockStore) objectKey(key string) *string {
+	return aws.String(s.c.Prefix + key)
+}
+
+// Put uploads p in a single request, or as a multipart upload if it is larger
+// than the part size. Either way, S3 only makes the object visible once it is
+// complete.
+func (s *s3BlockStore) Put(key string, p []byte) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+		Body:   bytes.NewReader(p),
+	})
+	return err
+}
+
+func (s *s3BlockStore) Get(key string) ([]byte, error) {
+	buffer := aws.NewWriteAtBuffer([]byte{})
+	_, err := s.downloader.Download(buffer, &s3.GetObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (s *s3BlockStore) GetRange(key string, offset int64, length int) ([]byte, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+int64(length)-1)),
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	defer output.Body.Close()
+
+	p := make([]byte, length)
+	_, err = io.ReadFull(output.Body, p)
+	if err != nil {
+		return []byte{}, err
+	}
+	return p, nil
+}
+
+func (s *s3BlockStore) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+	})
+	return err
+}
+
+func (s *s3BlockStore) Exists(key string) (bool, error) {
+	_, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == 404 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3BlockStore) Size(key string) (int64, error) {
+	head, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return aws.Int64Value(head.ContentLength), nil
+}
+
+func (s *s3BlockStore) ModTime(key string) (time.Time, error) {
+	head, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.c.Bucket),
+		Key:    s.objectKey(key),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return aws.TimeValue(head.LastModified), nil
+}
+
+func (s *s3BlockStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.c.Bucket),
+		Prefix: s.objectKey(prefix),
+	}, func(page *s3.ListObjectsV2Output, isLastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.StringValue(object.Key), s.c.Prefix))
+		}
+		return true
+	})
+	return keys, err
+}
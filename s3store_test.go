@@ -0,0 +1,96 @@
+package edis
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func TestS3BlockStore(t *testing.T) {
+	server, err := startS3Server("edis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	store, err := MakeS3BlockStore(S3Configuration{
+		Bucket:          "edis",
+		Prefix:          "blocks/",
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "edis",
+		SecretAccessKey: "edis",
+		IsPathStyle:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough to be uploaded in several parts.
+	large := make([]byte, 12*1024*1024)
+	rand.Read(large)
+	err = store.Put("large.edis", large)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := store.Get("large.edis")
+	if err != nil || !bytes.Equal(p, large) {
+		t.Fatalf("Multipart block did not round trip: %v", err)
+	}
+
+	withS3 := e
+	withS3.store = store
+	withS3.c.NumberOfWriters = 4
+
+	objectName, path, file, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	err = writeToJunkFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = withS3.SaveObject(file, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := store.List(objectName + "-")
+	if err != nil || len(keys) != DefaultJunkFileSizeInMB*1024*1024/BlockSizeInBytes {
+		t.Fatalf("S3 holds blocks %v of %s", keys, objectName)
+	}
+
+	var retrieved bytes.Buffer
+	err = withS3.RetrieveObjectTo(&retrieved, objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatalf("Object stored in S3 differs from the original")
+	}
+}
+
+// startS3Server starts an in-memory S3 server holding an empty bucket.
+func startS3Server(bucket string) (*httptest.Server, error) {
+	backend := s3mem.New()
+	err := backend.CreateBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(gofakes3.New(backend).Server()), nil
+}
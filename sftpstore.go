@@ -0,0 +1,271 @@
+package edis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultNumberOfSFTPConnections = 4
+
+// SFTPConfiguration describes a directory on a host reachable over SSH to keep
+// blocks in.
+type SFTPConfiguration struct {
+	Address   string // host:port
+	Directory string // relative to the home directory unless absolute
+	SSH       *ssh.ClientConfig
+
+	// NumberOfConnections is how many SSH connections are kept open, which
+	// bounds how many blocks are transferred at a time.
+	NumberOfConnections int
+}
+
+type sftpConnection struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+func (c *sftpConnection) close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+type sftpBlockStore struct {
+	c SFTPConfiguration
+
+	// connections is a pool of open connections. Connections that failed are
+	// returned as nil and reopened by the next user.
+	connections chan *sftpConnection
+}
+
+// MakeSFTPBlockStore returns a BlockStore that keeps blocks as files in a
+// directory of a remote host, accessed over SFTP.
+func MakeSFTPBlockStore(c SFTPConfiguration) (BlockStore, error) {
+	if c.Address == "" || c.SSH == nil {
+		return nil, fmt.Errorf("An SFTP address and SSH configuration must be given")
+	}
+
+	if c.NumberOfConnections <= 0 {
+		c.NumberOfConnections = defaultNumberOfSFTPConnections
+	}
+
+	s := &sftpBlockStore{
+		c:           c,
+		connections: make(chan *sftpConnection, c.NumberOfConnections),
+	}
+
+	// Connect once up front so that configuration errors show up early.
+	first, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	s.connections <- first
+	for i := 1; i < c.NumberOfConnections; i++ {
+		s.connections <- nil
+	}
+	return s, nil
+}
+
+func (s *sftpBlockStore) dial() (*sftpConnection, error) {
+	sshClient, err := ssh.Dial("tcp", s.c.Address, s.c.SSH)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s: %v", s.c.Address, err)
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("Could not start SFTP on %s: %v", s.c.Address, err)
+	}
+	return &sftpConnection{sshClient, sftpClient}, nil
+}
+
+// withConnection runs f with a connection from the pool. If f fails for any
+// reason other than a missing file, the connection is assumed to be broken
+// and is replaced.
+func (s *sftpBlockStore) withConnection(f func(client *sftp.Client) error) error {
+	conn := <-s.connections
+	if conn == nil {
+		var err error
+		conn, err = s.dial()
+		if err != nil {
+			s.connections <- nil
+			return err
+		}
+	}
+
+	err := f(conn.sftp)
+	if err != nil && !os.IsNotExist(err) {
+		conn.close()
+		conn = nil
+	}
+
+	s.connections <- conn
+	return err
+}
+
+func (s *sftpBlockStore) path(key string) string {
+	return path.Join(s.c.Directory, key)
+}
+
+// Put uploads p to a temporary file and renames it over the file backing key,
+// so that an interrupted upload never leaves a partial file under key.
+func (s *sftpBlockStore) Put(key string, p []byte) error {
+	temporaryPath, err := makeTemporaryKey(s.path(key))
+	if err != nil {
+		return err
+	}
+
+	return s.withConnection(func(client *sftp.Client) error {
+		err := client.MkdirAll(path.Dir(s.path(key)))
+		if err != nil {
+			return err
+		}
+
+		f, err := client.Create(temporaryPath)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.ReadFrom(bytes.NewReader(p))
+		if err != nil {
+			f.Close()
+			client.Remove(temporaryPath)
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			client.Remove(temporaryPath)
+			return err
+		}
+
+		err = client.PosixRename(temporaryPath, s.path(key))
+		if err != nil {
+			client.Remove(temporaryPath)
+		}
+		return err
+	})
+}
+
+func (s *sftpBlockStore) Get(key string) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := s.withConnection(func(client *sftp.Client) error {
+		f, err := client.Open(s.path(key))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.WriteTo(&buffer)
+		return err
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (s *sftpBlockStore) GetRange(key string, offset int64, length int) ([]byte, error) {
+	p := make([]byte, length)
+	err := s.withConnection(func(client *sftp.Client) error {
+		f, err := client.Open(s.path(key))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.ReadAt(p, offset)
+		return err
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	return p, nil
+}
+
+func (s *sftpBlockStore) Delete(key string) error {
+	err := s.withConnection(func(client *sftp.Client) error {
+		return client.Remove(s.path(key))
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *sftpBlockStore) Exists(key string) (bool, error) {
+	err := s.withConnection(func(client *sftp.Client) error {
+		_, err := client.Stat(s.path(key))
+		return err
+	})
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sftpBlockStore) Size(key string) (int64, error) {
+	var size int64
+	err := s.withConnection(func(client *sftp.Client) error {
+		info, err := client.Stat(s.path(key))
+		if err != nil {
+			return err
+		}
+
+		size = info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (s *sftpBlockStore) ModTime(key string) (time.Time, error) {
+	var modTime time.Time
+	err := s.withConnection(func(client *sftp.Client) error {
+		info, err := client.Stat(s.path(key))
+		if err != nil {
+			return err
+		}
+
+		modTime = info.ModTime()
+		return nil
+	})
+	return modTime, err
+}
+
+func (s *sftpBlockStore) List(prefix string) ([]string, error) {
+	var keys []string
+	err := s.withConnection(func(client *sftp.Client) error {
+		root := path.Clean(s.c.Directory)
+		walker := client.Walk(root)
+		for walker.Step() {
+			if walker.Err() != nil {
+				return walker.Err()
+			}
+
+			if !walker.Stat().Mode().IsRegular() {
+				continue
+			}
+
+			key := walker.Path()
+			if root != "." {
+				key = strings.TrimPrefix(key, root+"/")
+			}
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	return keys, err
+}
@@ -0,0 +1,148 @@
+package edis
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSFTPBlockStore(t *testing.T) {
+	listener, err := startSFTPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	directory, err := ioutil.TempDir("", "edis_sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	store, err := MakeSFTPBlockStore(SFTPConfiguration{
+		Address:   listener.Addr().String(),
+		Directory: directory,
+		SSH: &ssh.ClientConfig{
+			User:            "edis",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		NumberOfConnections: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withSFTP := e
+	withSFTP.store = store
+	withSFTP.c.NumberOfWriters = 2
+
+	objectName, path, file, err := createTemporaryFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	err = writeToJunkFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = withSFTP.SaveObject(file, objectName, BlockSizeInBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := store.List(objectName + "-")
+	if err != nil || len(keys) != DefaultJunkFileSizeInMB*1024*1024/BlockSizeInBytes {
+		t.Fatalf("SFTP server holds blocks %v of %s", keys, objectName)
+	}
+
+	var retrieved bytes.Buffer
+	err = withSFTP.RetrieveObjectTo(&retrieved, objectName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := read(path, DefaultJunkFileSizeInMB*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(retrieved.Bytes(), content) {
+		t.Fatalf("Object stored over SFTP differs from the original")
+	}
+}
+
+func startSFTPServer() (net.Listener, error) {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return listener, nil
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "Only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for request := range requests {
+				request.Reply(request.Type == "subsystem", nil)
+			}
+		}()
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			server.Serve()
+			server.Close()
+		}()
+	}
+}
@@ -0,0 +1,253 @@
+package edis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Storing a version writes its files before anything refers to them, and then
+// records the version and its blocks in one transaction. Until then, the
+// version has a PendingStore, and every file written for it is staged first,
+// so that what an interrupted store wrote can be found and removed again.
+
+// beginStore records that the files of ov are about to be written.
+func (e *Engine) beginStore(ov ObjectVersion) (PendingStore, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return PendingStore{}, err
+	}
+
+	p := PendingStore{ObjectName: ov.Name, Version: ov.Version, Hostname: hostname, PID: os.Getpid()}
+	err = e.db.Create(&p).Error
+	if err != nil {
+		return p, fmt.Errorf("Could not start storing version %d of %s, which may already be being stored: %v",
+			ov.Version, ov.Name, err)
+	}
+	return p, nil
+}
+
+// beginMaintenance records a store of no object, under which maintenance that
+// removes or moves files, such as collecting garbage or repacking, stages the
+// files it touches. Only one can be recorded at a time.
+func (e *Engine) beginMaintenance() (PendingStore, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return PendingStore{}, err
+	}
+
+	p := PendingStore{Hostname: hostname, PID: os.Getpid()}
+	return p, e.db.Create(&p).Error
+}
+
+// stageFile records that a file is about to be written at location for ov, if
+// ov is being stored.
+func (e *Engine) stageFile(ov ObjectVersion, location string) error {
+	return e.db.Exec("INSERT INTO staged_files (pending_store_id, location) "+
+		"SELECT id, ? FROM pending_stores WHERE object_name = ? AND version = ?",
+		location, ov.Name, ov.Version).Error
+}
+
+// claimLocation stages location for ov unless a block or another store uses
+// it, and reports whether it did.
+func (e *Engine) claimLocation(ov ObjectVersion, location string) (bool, error) {
+	claim := e.db.Exec("INSERT INTO staged_files (pending_store_id, location) "+
+		"SELECT id, ? FROM pending_stores WHERE object_name = ? AND version = ? "+
+		"AND NOT EXISTS (SELECT 1 FROM blocks WHERE location = ?) "+
+		"AND NOT EXISTS (SELECT 1 FROM staged_files WHERE location = ?)",
+		location, ov.Name, ov.Version, location, location)
+	return claim.RowsAffected > 0, claim.Error
+}
+
+// claimKey stages key for ov unless a block or another store uses it, in which
+// case a key of its own next to it is staged instead, so that a file someone
+// else relies on is never replaced. It returns the key that was staged.
+func (e *Engine) claimKey(ov ObjectVersion, key string) (string, error) {
+	isClaimed, err := e.claimLocation(ov, key)
+	if err != nil || isClaimed {
+		return key, err
+	}
+
+	name := make([]byte, 8)
+	_, err = rand.Read(name)
+	if err != nil {
+		return key, err
+	}
+
+	extension := path.Ext(key)
+	key = strings.TrimSuffix(key, extension) + "-" + hex.EncodeToString(name) + extension
+	return key, e.stageFile(ov, key)
+}
+
+// stageStoredFile records that ov uses the file of b, a recorded block, and
+// reports whether a recorded block still uses it. If none does, the file may
+// be being removed, and its content has to be stored again.
+func (e *Engine) stageStoredFile(ov ObjectVersion, b Block) (bool, error) {
+	stage := e.db.Exec("INSERT INTO staged_files (pending_store_id, location, data_key_id) "+
+		"SELECT id, ?, ? FROM pending_stores WHERE object_name = ? AND version = ? "+
+		"AND EXISTS (SELECT 1 FROM blocks WHERE location = ?)",
+		b.Location, b.DataKeyID, ov.Name, ov.Version, b.Location)
+	return stage.RowsAffected > 0, stage.Error
+}
+
+// findStoredContent returns how content with the given fingerprint is stored,
+// if any block has it, and stages its file for ov.
+func (e *Engine) findStoredContent(ov ObjectVersion, algorithm, checksum string) (Block, bool, error) {
+	isStored, err := e.isFileContentNew(algorithm, checksum)
+	if err != nil || !isStored {
+		return Block{}, false, err
+	}
+
+	b, err := e.getBlockWithChecksum(algorithm, checksum)
+	if err != nil {
+		return b, false, err
+	}
+
+	isStaged, err := e.stageStoredFile(ov, b)
+	return b, isStaged, err
+}
+
+// commitStore records ov along with blocks, the blocks it changed, and ends
+// the store p, all in one transaction.
+func (e *Engine) commitStore(p PendingStore, ov ObjectVersion, blocks []Block) error {
+	tx := e.db.Begin()
+	err := tx.Create(&ov).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i := 0; i < len(blocks); i++ {
+		err = tx.Create(&blocks[i]).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = deletePendingStore(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func deletePendingStore(db *gorm.DB, p PendingStore) error {
+	err := db.Exec("DELETE FROM staged_files WHERE pending_store_id = ?", p.ID).Error
+	if err != nil {
+		return err
+	}
+	return db.Delete(&p).Error
+}
+
+// abandonStore removes the files the store p wrote that no block uses, along
+// with the packs and parity groups it created, and forgets p.
+func (e *Engine) abandonStore(p PendingStore) error {
+	var staged []StagedFile
+	err := e.db.Where("pending_store_id = ?", p.ID).Find(&staged).Error
+	if err != nil {
+		return err
+	}
+
+	for _, f := range staged {
+		// Files the store did not write are used by blocks or other
+		// stores.
+		var count int
+		err = e.db.Model(&Block{}).Where("location = ?", f.Location).Count(&count).Error
+		if err == nil && count == 0 {
+			err = e.db.Model(&StagedFile{}).Where("location = ? AND pending_store_id != ?", f.Location, p.ID).
+				Count(&count).Error
+		}
+
+		if err != nil {
+			return err
+		} else if count > 0 {
+			continue
+		}
+
+		err = e.store.Delete(f.Location)
+		if err != nil {
+			return err
+		}
+
+		err = e.db.Exec("DELETE FROM packs WHERE location = ?", f.Location).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	var groups []ParityGroup
+	err = e.db.Where("object_name = ? AND version = ?", p.ObjectName, p.Version).Find(&groups).Error
+	if err != nil {
+		return err
+	}
+
+	tx := e.db.Begin()
+	for i := 0; i < len(groups); i++ {
+		err = tx.Exec("DELETE FROM parity_shards WHERE parity_group_id = ?", groups[i].ID).Error
+		if err == nil {
+			err = tx.Delete(&groups[i]).Error
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err = deletePendingStore(tx, p)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// recoverIncompleteStores abandons the stores started on this machine by
+// processes that are no longer running. Stores started elsewhere are left
+// alone, since whether they are still running cannot be told.
+func (e *Engine) recoverIncompleteStores() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	var pending []PendingStore
+	err = e.db.Where("hostname = ?", hostname).Find(&pending).Error
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		if p.PID == os.Getpid() || isProcessRunning(p.PID) {
+			continue
+		}
+
+		err = e.abandonStore(p)
+		if err != nil {
+			return fmt.Errorf("Could not clean up the incomplete store of version %d of %s: %v",
+				p.Version, p.ObjectName, err)
+		}
+	}
+	return nil
+}
+
+// abandonStoreOnError abandons p if err, the outcome of the store, is not nil,
+// rather than leaving what it wrote until the next start. It returns err.
+func (e *Engine) abandonStoreOnError(p PendingStore, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	abandonErr := e.abandonStore(p)
+	if abandonErr != nil {
+		return fmt.Errorf("%v (could not clean up the files written: %v)", err, abandonErr)
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package edis
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncStats describes what SyncTo or ImportObjectVersion copied.
+type SyncStats struct {
+	Versions int   // object versions copied
+	Files    int   // block files written to the destination
+	Bytes    int64 // uncompressed bytes of those files
+}
+
+// SyncTo copies the versions of objects that dst does not have yet into it.
+// If name is empty every object is copied, otherwise only the object with
+// that name is. Of each object, the versions newer than the newest one dst
+// has are copied, oldest first.
+//
+// Blocks that the previous version in dst already has are not copied, and
+// neither are blocks whose content dst has stored for any object. The rest
+// are decrypted and encrypted again with the keys of dst, so the two
+// repositories may have different master keys and settings.
+//
+// Every version is recorded in dst along with its blocks once all of them are
+// stored, so an interrupted sync can be resumed by running it again.
+func (e *Engine) SyncTo(dst *Engine, name string) (SyncStats, error) {
+	stats := SyncStats{}
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = e.getObjectNames()
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	for _, objectName := range names {
+		versions, err := e.getObjectVersions(objectName)
+		if err != nil {
+			return stats, err
+		} else if len(versions) == 0 {
+			return stats, fmt.Errorf("Could not find any objects with name %s", objectName)
+		}
+
+		newest := 0
+		isNew, err := dst.isObjectNew(objectName)
+		if err != nil {
+			return stats, err
+		} else if !isNew {
+			newest, err = dst.GetLatestVersionNumber(objectName)
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		for _, ov := range versions {
+			if ov.Version <= newest {
+				continue
+			}
+
+			blocks, err := e.loadBlockInfos(ov.Name, ov.Version)
+			if err != nil {
+				return stats, err
+			}
+
+			err = dst.copyObjectVersion(ov, blocks, e.readBlock, &stats)
+			if err != nil {
+				return stats, fmt.Errorf("Could not sync version %d of %s: %v", ov.Version, ov.Name, err)
+			}
+			stats.Versions++
+		}
+	}
+	return stats, nil
+}
+
+// copyObjectVersion records ov, a version of an object from elsewhere, in e
+// along with blocks, its complete list of blocks as described there. e must
+// not have a newer version of the object. The contents of blocks that the
+// previous version in e does not have, and that no block in e has, are
+// stored; read returns the content of such a block, and is called for blocks
+// in order.
+func (e *Engine) copyObjectVersion(ov ObjectVersion, blocks []Block, read func(b Block) ([]byte, error), stats *SyncStats) error {
+	pending, err := e.beginStore(ov)
+	if err != nil {
+		return err
+	}
+
+	dk, err := e.getDataKeyForObject(ov.Name)
+	if err != nil {
+		return e.abandonStoreOnError(pending, err)
+	}
+
+	copied, err := e.copyBlocks(ov, dk.ID, blocks, read, stats)
+	if err != nil {
+		return e.abandonStoreOnError(pending, err)
+	}
+
+	// Versions stored before creation times were recorded keep the epoch
+	// rather than getting the time of the copy.
+	if ov.CreatedAt.IsZero() {
+		ov.CreatedAt = time.Unix(0, 0).UTC()
+	}
+	return e.abandonStoreOnError(pending, e.commitStore(pending, ov, copied))
+}
+
+// copyBlocks stores what copyObjectVersion needs to of blocks, and returns the
+// blocks ov changed as they are to be recorded in e.
+func (e *Engine) copyBlocks(ov ObjectVersion, dataKeyID uint, blocks []Block, read func(b Block) ([]byte, error),
+	stats *SyncStats) ([]Block, error) {
+	packs, err := e.makePackWriter(ov, e.c.PackSize)
+	if err != nil {
+		return nil, err
+	}
+
+	parity, err := e.makeParityWriter(ov, e.c.DataShards, e.c.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied []Block
+	for _, b := range blocks {
+		candidate := Block{
+			BlockIndex: b.BlockIndex,
+			ByteOffset: getBlockOffset(b, ov.BlockSize),
+			ByteLength: b.ByteLength,
+			IsHole:     b.IsHole,
+			Checksum:   b.Checksum,
+		}
+
+		// Keyed fingerprints differ between repositories, so they have to
+		// be computed again from the content.
+		var p []byte
+		if !b.IsHole && b.ChecksumAlgorithm == checksumHMACSHA256 {
+			p, err = read(b)
+			if err != nil {
+				return nil, err
+			}
+
+			candidate.Checksum, err = e.computeChecksum(checksumHMACSHA256, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		isBlockNew, err := e.isBlockNew(ov, candidate)
+		if err != nil {
+			return nil, err
+		} else if !isBlockNew {
+			continue
+		}
+
+		if !b.IsHole {
+			stored, isStored, err := e.findStoredContent(ov, b.ChecksumAlgorithm, candidate.Checksum)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isStored {
+				if p == nil {
+					p, err = read(b)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				stored, err = e.writeBytesAsBlock(ov, dataKeyID, packs, parity, b.BlockIndex, candidate.Checksum, p)
+				if err != nil {
+					return nil, err
+				}
+				stats.Files++
+				stats.Bytes += int64(len(p))
+			}
+
+			candidate.Location = stored.Location
+			candidate.Nonce = stored.Nonce
+			candidate.Tag = stored.Tag
+			candidate.IsPlaintext = stored.IsPlaintext
+			candidate.DataKeyID = stored.DataKeyID
+			candidate.IsConvergent = stored.IsConvergent
+			candidate.Codec = stored.Codec
+			candidate.StoredLength = stored.StoredLength
+			candidate.PackID = stored.PackID
+			candidate.PackOffset = stored.PackOffset
+		}
+
+		candidate.ChecksumAlgorithm = b.ChecksumAlgorithm
+		candidate.ObjectName = ov.Name
+		candidate.Version = ov.Version
+		copied = append(copied, candidate)
+	}
+
+	if packs != nil {
+		err = packs.flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if parity != nil {
+		err = parity.flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return copied, nil
+}
@@ -2,42 +2,80 @@
 
 go build $PATH_TO_EXECUTABLE
 
+head -c 32 /dev/urandom > TEST_KEY
+
 dd bs=1M count=1 if=/dev/urandom of=a_v1.bin status=none
 
-./edis store --db ./TEST_DB --storage /var/tmp --name a --input a_v1.bin
-./edis retrieve --db ./TEST_DB --storage /var/tmp --name a --latest --output a_v1.retrieved
+./edis store --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --input a_v1.bin
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --latest --output a_v1.retrieved
 
 test=$(cmp -s a_v1.bin a_v1.retrieved && echo "passed" || echo "failed")
 if [ "failed" == $test ]
 then
   echo "Tests failed! Version 1 wasn't properly retrieved"
-  rm TEST_DB
+  rm TEST_DB TEST_KEY
   exit 1
 fi
 
 dd bs=1M count=1 if=/dev/urandom of=a_v2.bin status=none
-./edis store --db ./TEST_DB --storage /var/tmp --name a --input a_v2.bin
-./edis retrieve --db ./TEST_DB --storage /var/tmp --name a --latest --output a_v2.retrieved
+./edis store --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --input a_v2.bin
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --latest --output a_v2.retrieved
 
 test=$(cmp -s a_v2.bin a_v2.retrieved && echo "passed" || echo "failed")
 if [ "failed" == $test ]
 then
   echo "Tests failed! Version 2 wasn't properly retrieved"
-  rm TEST_DB
+  rm TEST_DB TEST_KEY
   exit 1
 fi
 
-./edis retrieve --db ./TEST_DB --storage /var/tmp --name a --version 1 --output a_v1.retrieved
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --version 1 --output a_v1.retrieved
 test=$(cmp -s a_v1.bin a_v1.retrieved && echo "passed" || echo "failed")
 if [ "failed" == $test ]
 then
   echo "Tests failed! Version 1 wasn't properly retrieved after storing version 1"
-  rm TEST_DB
+  rm TEST_DB TEST_KEY
+  exit 1
+fi
+
+dd bs=1M count=1 if=/dev/urandom of=a_v3.bin status=none
+cat a_v3.bin | ./edis store --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --input -
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --latest --output a_v3.retrieved
+
+test=$(cmp -s a_v3.bin a_v3.retrieved && echo "passed" || echo "failed")
+if [ "failed" == $test ]
+then
+  echo "Tests failed! Version 3 wasn't properly retrieved after storing it from standard input"
+  rm TEST_DB TEST_KEY
+  exit 1
+fi
+
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --version 2 --output - > a_v2.retrieved
+test=$(cmp -s a_v2.bin a_v2.retrieved && echo "passed" || echo "failed")
+if [ "failed" == $test ]
+then
+  echo "Tests failed! Version 2 wasn't properly retrieved to standard output"
+  rm TEST_DB TEST_KEY
+  exit 1
+fi
+
+head -c 32 /dev/urandom > TEST_KEY_NEW
+./edis key rotate --db ./TEST_DB --keyfile ./TEST_KEY --new-keyfile ./TEST_KEY_NEW
+mv TEST_KEY_NEW TEST_KEY
+./edis retrieve --db ./TEST_DB --storage /var/tmp --keyfile ./TEST_KEY --name a --version 1 --output a_v1.retrieved
+test=$(cmp -s a_v1.bin a_v1.retrieved && echo "passed" || echo "failed")
+if [ "failed" == $test ]
+then
+  echo "Tests failed! Version 1 wasn't properly retrieved after rotating the master key"
+  rm TEST_DB TEST_KEY
   exit 1
 fi
 
 rm a_v1.bin
 rm a_v2.bin
+rm a_v3.bin
 rm a_v1.retrieved
 rm a_v2.retrieved
-rm TEST_DB
\ No newline at end of file
+rm a_v3.retrieved
+rm TEST_DB
+rm TEST_KEY
\ No newline at end of file
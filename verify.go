@@ -0,0 +1,155 @@
+package edis
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// VerificationReport lists the problems Verify found. Each entry describes
+// one problem.
+type VerificationReport struct {
+	Versions int // object versions checked
+	Files    int // block files read back
+
+	Unresolvable []string // versions missing blocks in the database
+	Missing      []string // blocks whose file is gone
+	Corrupt      []string // blocks whose file does not decrypt to their checksum
+	Orphaned     []string // block files no block uses
+}
+
+// IsHealthy reports whether no problems were found.
+func (r VerificationReport) IsHealthy() bool {
+	return len(r.Unresolvable)+len(r.Missing)+len(r.Corrupt)+len(r.Orphaned) == 0
+}
+
+// Verify checks that versions of objects can be retrieved. Every version
+// must resolve to a complete list of blocks, whose files must exist.
+// samplePercent percent of the files, picked at random, are also read back,
+// decrypted and checked against the checksum of their blocks.
+//
+// If name is empty every object is checked, and block files no block uses
+// are reported as orphaned; otherwise only the object with that name is. If
+// version is 0, every version of the object is checked.
+func (e *Engine) Verify(name string, version int, samplePercent float64) (VerificationReport, error) {
+	report := VerificationReport{}
+	if samplePercent < 0 || samplePercent > 100 {
+		return report, fmt.Errorf("Sample must be between 0 and 100 percent, got %v", samplePercent)
+	}
+
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = e.getObjectNames()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// Blocks with the same content share a file, which is only checked once.
+	checked := make(map[string]error)
+	for _, objectName := range names {
+		versions, err := e.getObjectVersions(objectName)
+		if err != nil {
+			return report, err
+		} else if len(versions) == 0 {
+			return report, fmt.Errorf("Could not find any objects with name %s", objectName)
+		}
+
+		all, err := e.getAllBlocks(objectName)
+		if err != nil {
+			return report, err
+		}
+
+		isFound := false
+		for _, ov := range versions {
+			if version != 0 && ov.Version != version {
+				continue
+			}
+
+			isFound = true
+			report.Versions++
+			blocks, err := getLatestBlocks(ov, all)
+			if err != nil {
+				report.Unresolvable = append(report.Unresolvable,
+					fmt.Sprintf("%s version %d: %v", ov.Name, ov.Version, err))
+				continue
+			}
+
+			for _, b := range blocks {
+				if b.IsHole {
+					continue
+				}
+
+				file := fmt.Sprintf("%s@%d", b.Location, b.PackOffset)
+				problem, found := checked[file]
+				if !found {
+					problem = e.verifyBlockFile(b, samplePercent, &report)
+					checked[file] = problem
+				}
+
+				if problem == errMissingBlockFile {
+					report.Missing = append(report.Missing, describeBlock(b, ov, problem))
+				} else if problem != nil {
+					report.Corrupt = append(report.Corrupt, describeBlock(b, ov, problem))
+				}
+			}
+		}
+
+		if !isFound {
+			return report, fmt.Errorf("Could not find version %d of object %s", version, objectName)
+		}
+	}
+
+	if name != "" {
+		return report, nil
+	}
+
+	keys, err := e.store.List("")
+	if err != nil {
+		return report, err
+	}
+
+	usage, err := e.getUsage()
+	if err != nil {
+		return report, err
+	}
+
+	report.Orphaned, err = e.findUnusedBlockFiles(keys, usage.isUsed)
+	return report, err
+}
+
+var errMissingBlockFile = fmt.Errorf("Block file is missing")
+
+// verifyBlockFile returns errMissingBlockFile if the file of b does not
+// exist. If the file is sampled, it also returns why it cannot be read back
+// as the content b records.
+func (e *Engine) verifyBlockFile(b Block, samplePercent float64, report *VerificationReport) error {
+	exists, err := e.store.Exists(b.Location)
+	if err != nil {
+		return err
+	} else if !exists {
+		return errMissingBlockFile
+	}
+
+	if rand.Float64()*100 >= samplePercent {
+		return nil
+	}
+
+	report.Files++
+	p, err := e.readBlock(b)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := e.computeChecksum(b.ChecksumAlgorithm, p)
+	if err != nil {
+		return err
+	} else if checksum != b.Checksum {
+		return fmt.Errorf("Checksum is %s instead of %s", checksum, b.Checksum)
+	}
+	return nil
+}
+
+func describeBlock(b Block, ov ObjectVersion, problem error) string {
+	return fmt.Sprintf("%s version %d block %d at %s: %v", ov.Name, ov.Version, b.BlockIndex, b.Location, problem)
+}